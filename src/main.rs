@@ -1,6 +1,8 @@
 use std::borrow::Cow;
+use std::collections::BTreeMap;
 use std::io::{BufRead, Read, Write};
-use std::time::SystemTime;
+use std::net::IpAddr;
+use std::time::{Duration, SystemTime};
 
 use base64::Engine;
 use fastly::handle::BodyHandle;
@@ -8,28 +10,126 @@ use fastly::http::{Method, header};
 use fastly::kv_store::InsertMode;
 use fastly::{Error, KVStore, Request, Response, cache, mime};
 use humanize_bytes::humanize_bytes_binary;
-use humantime::format_duration;
+use humantime::{format_duration, format_rfc3339_seconds};
 use pad::PadStr;
 use serde_json::json;
-use types::FileMetadata;
+use types::{FileMetadata, Renderer, ResponseFormat};
 
 mod config {
     use std::time::Duration;
 
     /// Upload ID length, up to 64 bytes
     pub const ID_SIZE: usize = 8;
+    /// Encoding for upload ids
+    pub const ID_ENCODING: IdEncoding = IdEncoding::Base58;
     /// Minimum content size in bytes
     pub const MIN_CONTENT_SIZE: usize = 32;
     /// Maximum content size in bytes
     pub const MAX_CONTENT_SIZE: usize = 24 << 20;
+    /// Maximum size of a single kv store value, which api key size overrides are clamped to
+    pub const KV_MAX_VALUE_SIZE: usize = 25 << 20;
     /// Fastly key-value storage name
     pub const KV_STORE: &str = "paste storage";
-    /// TTL for content
-    pub const KV_TTL: Duration = Duration::from_secs(14 * 86400);
+    /// Fastly config store name for api keys, mapping blake3 hex hashes of keys to their limits
+    pub const API_KEY_STORE: &str = "api keys";
+    /// Fastly config store name for taken down pastes, mapping ids to the reason for removal
+    pub const DENYLIST_STORE: &str = "denylist";
+    /// Minimum TTL for content, applied to uploads at the maximum content size
+    pub const KV_MIN_TTL: Duration = Duration::from_secs(30 * 86400);
+    /// Maximum TTL for content, applied to the smallest uploads (1 year, 365.25 days)
+    pub const KV_MAX_TTL: Duration = Duration::from_secs(31_557_600);
     /// Request cache ttl
     pub const CACHE_TTL: Duration = Duration::from_secs(90 * 86400);
     /// Key to store upload metrics under
     pub const UPLOAD_METRICS_KEY: &str = "_upload_metrics";
+    /// Key prefix for vendored static assets (ie, katex and mermaid) served from /static/
+    pub const STATIC_ASSET_PREFIX: &str = "_static/";
+    /// Maximum size of each paste to compute diffs for
+    pub const DIFF_MAX_SIZE: usize = 1024 * 1024;
+    /// Deadline for computing a diff, after which a less minimal diff is returned
+    pub const DIFF_TIMEOUT: Duration = Duration::from_millis(500);
+    /// Maximum size of snippets sent to /api/detect
+    pub const DETECT_MAX_SIZE: usize = 8 * 1024;
+    /// Key to append abuse reports to, for review by the operator
+    pub const REPORTS_KEY: &str = "_reports";
+    /// Maximum length of an abuse report reason
+    pub const MAX_REPORT_SIZE: usize = 1024;
+    /// Maximum number of abuse reports a client can send per day
+    pub const DAILY_REPORT_LIMIT: usize = 10;
+    /// Key to append pastes uploaded with ?public to, for the recent listing and feed
+    pub const PUBLIC_PASTES_KEY: &str = "_public_pastes";
+    /// Number of public pastes to show on the recent listing and feed
+    pub const RECENT_PASTES: usize = 50;
+    /// Number of days to show upload history for on the stats page
+    pub const STATS_DAYS: u64 = 30;
+    /// Minimum number of headings in a markdown document to render a table of contents for
+    pub const MARKDOWN_TOC_MIN_HEADINGS: usize = 3;
+    /// Require browser uploads to accept the terms of service (privacy policy) first
+    pub const REQUIRE_TOS: bool = false;
+    /// Always strip exif and text metadata from jpeg and png uploads, not only with ?strip
+    pub const STRIP_METADATA: bool = false;
+    /// Serve svg images as downloads unless requested with ?raw, since they can carry scripts
+    pub const SVG_ATTACHMENT: bool = true;
+    /// Canonical host (and port) to use in generated links, instead of the request host header
+    pub const CANONICAL_HOST: Option<&str> = None;
+    /// Redirect plain http requests to https (except when running locally)
+    pub const HTTPS_REDIRECT: bool = true;
+    /// Max age for the HSTS header, or none to disable it
+    pub const HSTS_MAX_AGE: Option<Duration> = Some(Duration::from_secs(15768000));
+    /// Request inclusion in browser HSTS preload lists (requires a max age of at least 1 year)
+    pub const HSTS_PRELOAD: bool = false;
+    /// Detected mime type prefixes to accept for uploads (ie, "text/" or "image/png"), or
+    /// empty to accept everything not denied
+    pub const ALLOWED_MIME_TYPES: &[&str] = &[];
+    /// Detected mime type prefixes to reject uploads for (ie, "application/x-msdownload")
+    pub const DENIED_MIME_TYPES: &[&str] = &[];
+    /// Maximum bytes a client ip can upload per day, or none to disable. Api keys are exempt.
+    pub const DAILY_UPLOAD_QUOTA: Option<usize> = Some(1024 * 1024 * 1024);
+    /// Maximum number of bytes to read for a paste preview with ?head
+    pub const PREVIEW_MAX_SIZE: u64 = 64 * 1024;
+    /// Key for the secret used to hash client addresses for upload quotas
+    pub const QUOTA_SECRET_KEY: &str = "_quota_secret";
+    /// Maximum number of rows to render for csv tables
+    pub const CSV_MAX_ROWS: usize = 1000;
+    /// Behavior of the root route
+    pub const LANDING_PAGE: LandingPage = LandingPage::Interactive;
+    /// Cache ttl for the computed stats page
+    pub const STATS_CACHE_TTL: Duration = Duration::from_secs(300);
+    /// Domains (and their subdomains) that rendered links may point to without the exit page
+    pub const TRUSTED_LINK_DOMAINS: &[&str] = &["github.com", "gitlab.com", "codeberg.org"];
+
+    /// Upload id encodings, derived from the content hash
+    #[allow(dead_code)]
+    pub enum IdEncoding {
+        /// Prefix of the base58 encoded hash, `ID_SIZE` characters long
+        Base58,
+        /// Proquints of the first hash bytes (ie, "lusab-babad-gutih"), which are easier to read
+        /// out loud or type from paper. Each word encodes two bytes of the hash.
+        Proquint { words: usize },
+    }
+
+    /// Landing page modes, for deployments that want an upload-only api host
+    #[allow(dead_code)]
+    pub enum LandingPage {
+        /// Usage page, wrapped with the interactive paste form for browsers
+        Interactive,
+        /// Plain text usage page for all clients
+        Text,
+        /// Static html page, ie `Custom(include_str!("static/landing.html"))`
+        Custom(&'static str),
+        /// No landing page, respond with a 404
+        Disabled,
+    }
+
+    /// Compute the storage TTL for a given content size. Smaller files are kept longer, following
+    /// a cubic curve between the maximum and minimum TTL (same retention curve as 0x0.st).
+    pub fn kv_ttl(size: usize) -> Duration {
+        let min = KV_MIN_TTL.as_secs_f64();
+        let max = KV_MAX_TTL.as_secs_f64();
+        let ratio = size as f64 / MAX_CONTENT_SIZE as f64;
+        let ttl = min + (min - max) * (ratio - 1.0).powi(3);
+        Duration::from_secs_f64(ttl.clamp(min, max))
+    }
 }
 
 mod types {
@@ -41,14 +141,46 @@ mod types {
     pub struct FileMetadata<'a> {
         pub hash: [u8; 32],
         pub mime: Cow<'a, str>,
+        /// Unix timestamp (seconds) the content expires from storage at
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        pub expires: Option<u64>,
+        /// Id of the paste this upload was declared as a reply to
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        pub reply_to: Option<String>,
+        /// SPDX license identifier declared for the content
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        pub license: Option<String>,
+        /// BCP 47 language tag declared for the content
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        pub language: Option<String>,
+        /// Whether the uploader accepted the terms of service from the web form
+        #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+        pub tos_accepted: bool,
+        /// Name of the api key used to upload the content
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        pub uploader: Option<String>,
+        /// Size of the content in bytes
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        pub size: Option<usize>,
+        /// Unix timestamp (seconds) the content was first uploaded at
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        pub created: Option<u64>,
     }
 
     impl FileMetadata<'_> {
         #[inline(always)]
-        pub fn new(hash: [u8; 32], mime: String) -> Self {
+        pub fn new(hash: [u8; 32], mime: String, expires: u64) -> Self {
             Self {
                 hash,
                 mime: Cow::Owned(mime),
+                expires: Some(expires),
+                reply_to: None,
+                license: None,
+                language: None,
+                tos_accepted: false,
+                uploader: None,
+                size: None,
+                created: None,
             }
         }
 
@@ -57,6 +189,93 @@ mod types {
             &self.mime
         }
     }
+
+    /// Response formats negotiated with clients
+    #[derive(Clone, Copy, PartialEq, Eq)]
+    pub enum ResponseFormat {
+        /// Plain text, for command line clients
+        Text,
+        /// Html, for browsers
+        Html,
+        /// Json, when explicitly accepted
+        Json,
+    }
+
+    /// Html renderers for paste content
+    #[derive(Clone, Copy, PartialEq, Eq)]
+    pub enum Renderer {
+        /// Github flavored markdown
+        Markdown,
+        /// Jupyter notebooks
+        Notebook,
+        /// Terminal output with ansi color codes
+        Ansi,
+        /// Comma or tab separated values
+        Table,
+        /// Json documents
+        Json,
+        /// Plain text with line anchors. Ranges given with `lines=` are highlighted in the
+        /// browser, so every range shares one cached render.
+        Code,
+    }
+
+    impl Renderer {
+        /// Select a renderer from the first query param (ie, `?md`), or from the filename
+        /// extension when given `?render`.
+        pub fn from_request(query: Option<&str>, filename: Option<&str>) -> Option<Self> {
+            let param = query?.split('&').next()?.split('=').next()?;
+            let name = match param {
+                "render" => filename?.rsplit_once('.')?.1,
+                p => p,
+            };
+            match name.to_ascii_lowercase().as_str() {
+                "md" | "markdown" => Some(Self::Markdown),
+                "nb" | "ipynb" => Some(Self::Notebook),
+                "ansi" | "log" => Some(Self::Ansi),
+                "csv" | "tsv" => Some(Self::Table),
+                "json" => Some(Self::Json),
+                "code" | "txt" => Some(Self::Code),
+                _ => None,
+            }
+        }
+
+        /// Unique key for the renderer and its options, for caching rendered output
+        pub fn cache_key(&self) -> String {
+            match self {
+                Self::Markdown => "md".into(),
+                Self::Notebook => "nb".into(),
+                Self::Ansi => "ansi".into(),
+                Self::Table => "csv".into(),
+                Self::Json => "json".into(),
+                Self::Code => "code".into(),
+            }
+        }
+
+        /// Page title to use when no filename is given
+        pub fn title(&self) -> &'static str {
+            match self {
+                Self::Markdown => "no bs markdown",
+                Self::Notebook => "no bs notebook",
+                Self::Ansi => "no bs terminal",
+                Self::Table => "no bs table",
+                Self::Json => "no bs json",
+                Self::Code => "no bs code",
+            }
+        }
+    }
+
+    /// Api key entry, stored as json in the api key config store
+    #[derive(Serialize, Deserialize)]
+    pub struct ApiKey {
+        /// Name the key's uploads are attributed to
+        pub name: String,
+        /// Override for the maximum content size in bytes
+        #[serde(default)]
+        pub max_size: Option<usize>,
+        /// Allow uploading permanent pastes that never expire, with ?keep
+        #[serde(default)]
+        pub keep: bool,
+    }
 }
 
 #[fastly::main]
@@ -66,45 +285,86 @@ fn main(req: Request) -> Result<Response, Error> {
         std::env::var("FASTLY_SERVICE_VERSION").unwrap_or_default()
     );
 
+    // Redirect plain http to https, preserving the method and body. The local development
+    // server only speaks plain http, so it is never redirected.
+    let is_local = std::env::var("FASTLY_HOSTNAME").is_ok_and(|h| h == "localhost");
+    if config::HTTPS_REDIRECT && !is_local && req.get_url().scheme() == "http" {
+        let mut url = req.get_url().clone();
+        let _ = url.set_scheme("https");
+        return Ok(Response::from_status(308).with_header(header::LOCATION, url.as_str()));
+    }
+
     let nonce = rand::random::<usize>();
 
-    let mut res = match req.get_method() {
-        &Method::PUT => handle_put(req)?,
-        &Method::GET | &Method::HEAD => handle_get(req, nonce)?,
-        _ => Response::from_status(403).with_body("invalid request"),
+    // Embeds are meant to be loaded and framed by other origins
+    let is_embed = req.get_path().starts_with("/embed/");
+
+    // Keep the request headers around, for negotiating the format of internal errors
+    let info = req.clone_without_body();
+    let res = match req.get_method() {
+        &Method::PUT => handle_put(req),
+        &Method::POST => handle_post(req),
+        &Method::GET | &Method::HEAD => handle_get(req, nonce),
+        _ => Ok(error_response(&req, 405, "invalid request")
+            .with_header(header::ALLOW, "GET, HEAD, PUT, POST")),
     };
+    let mut res = res.unwrap_or_else(|e| {
+        println!("error handling request: {e}");
+        error_response(&info, 500, "internal server error")
+    });
 
     // Enable fastly dynamic compression
     res.set_header("x-compress-hint", "on");
 
-    // Enable HSTS for 6mo
-    res.set_header(header::STRICT_TRANSPORT_SECURITY, "max-age=15768000");
+    // Enable HSTS
+    if let Some(max_age) = config::HSTS_MAX_AGE {
+        let mut hsts = format!("max-age={}", max_age.as_secs());
+        if config::HSTS_PRELOAD {
+            hsts += "; includeSubDomains; preload";
+        }
+        res.set_header(header::STRICT_TRANSPORT_SECURITY, hsts);
+    }
 
-    // Allow CORS, deny CORP unless same origin
+    // Allow CORS, deny CORP unless same origin (or an embed)
     res.set_header(header::ACCESS_CONTROL_ALLOW_ORIGIN, "*");
-    res.set_header("cross-origin-resource-policy", "same-origin");
+    res.set_header(
+        "cross-origin-resource-policy",
+        if is_embed {
+            "cross-origin"
+        } else {
+            "same-origin"
+        },
+    );
 
     // On same-origin send full referrer header, only send url for others
     res.set_header(header::REFERRER_POLICY, "strict-origin-when-cross-origin");
 
-    // Disable content sniffing, external iframe embeds
+    // Disable content sniffing, external iframe embeds (other than the embed views)
     res.set_header(header::X_CONTENT_TYPE_OPTIONS, "nosniff");
-    res.set_header(header::X_FRAME_OPTIONS, "SAMEORIGIN");
+    if !is_embed {
+        res.set_header(header::X_FRAME_OPTIONS, "SAMEORIGIN");
+    }
 
     // - Allow static external resources
     // - Allow external and inline styles
+    // - Allow inline data images (ie, notebook outputs)
     // - deny objects and embeds
     // - deny all scripts
-    // - deny all frame ancestors
+    // - deny all frame ancestors, unless embedding
     res.set_header(
         header::CONTENT_SECURITY_POLICY,
         [
             "default-src *",
-            "frame-ancestors 'none'",
+            if is_embed {
+                "frame-ancestors *"
+            } else {
+                "frame-ancestors 'none'"
+            },
             "object-src 'none'",
             "base-uri 'none'",
             "form-action 'none'",
             "style-src * 'unsafe-inline'",
+            "img-src * data:",
             &format!("script-src 'nonce-{nonce}'"),
         ]
         .join(";"),
@@ -116,57 +376,307 @@ fn main(req: Request) -> Result<Response, Error> {
 /// Handle a request to put a paste into storage
 #[inline(always)]
 fn handle_put(mut req: Request) -> Result<Response, Error> {
+    let api_key = match get_api_key(&req) {
+        Ok(key) => key,
+        Err(res) => return Ok(res),
+    };
+    let max_size = api_key
+        .as_ref()
+        .and_then(|k| k.max_size)
+        .map_or(config::MAX_CONTENT_SIZE, |s| {
+            s.min(config::KV_MAX_VALUE_SIZE)
+        });
+
+    // Permanent pastes are only allowed for keys with the permission
+    let keep = has_query_flag(&req, "keep");
+    if keep && !api_key.as_ref().is_some_and(|k| k.keep) {
+        return Ok(error_response(
+            &req,
+            403,
+            "an api key with the keep permission is required for ?keep",
+        ));
+    }
+
+    // Browsers (identified by fetch metadata headers) must accept the terms, unless using a key
+    let tos_accepted = req
+        .get_header_str(header::COOKIE)
+        .is_some_and(|c| c.split(';').any(|c| c.trim() == "tos=accepted"));
+    if config::REQUIRE_TOS
+        && api_key.is_none()
+        && !tos_accepted
+        && req.contains_header("sec-fetch-mode")
+    {
+        return Ok(error_response(
+            &req,
+            403,
+            "terms of service must be accepted before uploading",
+        ));
+    }
+
     // Check request body
     if !req.has_body() {
-        return Ok(Response::from_status(400).with_body_text_plain("missing upload body"));
+        return Ok(error_response(&req, 400, "missing upload body"));
     }
     let body = req.take_body_bytes();
+
+    // Transparently decompress uploads, reading no further than the size limit
+    let body = match req.get_header_str(header::CONTENT_ENCODING) {
+        None | Some("identity") => body,
+        Some(encoding) => {
+            let decoder: Box<dyn Read> = match encoding {
+                "gzip" | "x-gzip" => Box::new(flate2::read::GzDecoder::new(&body[..])),
+                "deflate" => Box::new(flate2::read::ZlibDecoder::new(&body[..])),
+                _ => {
+                    return Ok(error_response(&req, 415, "unsupported content encoding"));
+                },
+            };
+            let mut decoded = Vec::new();
+            if decoder
+                .take(max_size as u64 + 1)
+                .read_to_end(&mut decoded)
+                .is_err()
+            {
+                return Ok(error_response(&req, 400, "invalid compressed body"));
+            }
+            decoded
+        },
+    };
     if body.len() < config::MIN_CONTENT_SIZE && body != b"testing\n" {
-        return Ok(Response::from_status(400).with_body_text_plain("content too small"));
+        return Ok(error_response(&req, 400, "content too small"));
+    }
+    if body.len() > max_size {
+        return Ok(error_response(&req, 413, "content too large"));
     }
-    if body.len() > config::MAX_CONTENT_SIZE {
-        return Ok(Response::from_status(413).with_body_text_plain("content too large"));
+
+    // Remove location and camera metadata from images before hashing. Refuse images that
+    // can't be parsed, rather than publishing them with the metadata intact.
+    let body = if config::STRIP_METADATA || has_query_flag(&req, "strip") {
+        match strip_metadata(&body) {
+            Ok(stripped) => stripped.unwrap_or(body),
+            Err(e) => {
+                return Ok(error_response(
+                    &req,
+                    422,
+                    &format!("unable to strip metadata: {e}"),
+                ));
+            },
+        }
+    } else {
+        body
+    };
+
+    // Refuse text uploads that look like they contain credentials, unless forced
+    if !has_query_flag(&req, "force") {
+        let found = std::str::from_utf8(&body)
+            .map(detect_secrets)
+            .unwrap_or_default();
+        if !found.is_empty() {
+            return Ok(error_response(
+                &req,
+                422,
+                &format!(
+                    "content appears to contain secrets ({}), pastes are public and cannot be \
+                 deleted. re-upload with ?force to ignore",
+                    found.join(", ")
+                ),
+            ));
+        }
     }
 
     let url = req.get_url();
-    let host = url.host().unwrap().to_string();
+    let host = get_host(&req);
     let filename = url
         .path_segments()
         .unwrap()
         .next_back()
         .and_then(|v| (!v.is_empty()).then_some(v));
+    if filename.is_some_and(|f| decode_filename(f).is_none()) {
+        return Ok(error_response(&req, 400, "invalid filename"));
+    }
+    let reply_to = req.get_query_parameter("reply_to");
+    let license = req.get_query_parameter("license");
+    if let Some(license) = license {
+        let valid = license.len() <= 64
+            && license
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || matches!(c, '.' | '-' | '+'));
+        if !valid {
+            return Ok(error_response(&req, 400, "invalid license identifier"));
+        }
+    }
+    let language = req.get_query_parameter("lang");
+    if let Some(language) = language {
+        let valid = language.len() <= 35
+            && language
+                .split('-')
+                .all(|p| !p.is_empty() && p.chars().all(|c| c.is_ascii_alphanumeric()));
+        if !valid {
+            return Ok(error_response(&req, 400, "invalid language tag"));
+        }
+    }
 
-    // Hash content and use a section of base58 encoding for the id
+    // Hash content and use a section of the encoded hash for the id
     let hash = blake3::hash(&body);
-    let base = bs58::encode(hash.as_bytes()).into_string();
-    let id = &base[..config::ID_SIZE];
+    let id = &encode_id(hash.as_bytes());
     let key = &format!("file_{id}");
+    if let Some(reason) = get_takedown(id) {
+        return Ok(error_response(
+            &req,
+            451,
+            &format!("{id} was removed: {reason}"),
+        ));
+    }
 
     // Insert content to key value store
     let kv = KVStore::open(config::KV_STORE)?.expect("kv store to exist");
-    if kv.lookup(key).is_err() {
-        // try and detect mime type from magic byte sequences
-        let mime = infer::get(&body).map(|t| t.to_string()).unwrap_or_else(|| {
-            // try to detect from the (optionally) given filename
-            if let Some(mime) = filename.and_then(|f| mime_guess::from_path(f).into_iter().next()) {
-                mime.to_string()
-            } else if std::str::from_utf8(&body).is_ok() {
-                // if it's valid utf-8
-                mime::TEXT_PLAIN_UTF_8.to_string()
-            } else {
-                // fallback to raw octet stream bytes
-                mime::APPLICATION_OCTET_STREAM.to_string()
+
+    // Ensure the paste being replied to exists, and get its expiry for the list of replies
+    let mut parent_expires = None;
+    if let Some(parent) = reply_to {
+        let found = (parent != id && is_valid_id(parent))
+            .then(|| kv.lookup(&format!("file_{parent}")).ok())
+            .flatten();
+        let Some(found) = found else {
+            return Ok(error_response(
+                &req,
+                400,
+                &format!("reply_to paste {parent} not found"),
+            ));
+        };
+        let meta = found
+            .metadata()
+            .and_then(|m| serde_json::from_slice::<FileMetadata>(&m).ok());
+        parent_expires = meta.map(|m| m.expires);
+    }
+
+    let meta = match kv.lookup(key) {
+        // Content already exists, reuse the original metadata
+        Ok(res) => {
+            let mut meta = res
+                .metadata()
+                .and_then(|m| serde_json::from_slice::<FileMetadata>(&m).ok());
+
+            // Make existing content permanent, by storing it again without a ttl
+            if let Some(meta) = meta.as_mut().filter(|m| keep && m.expires.is_some()) {
+                meta.expires = None;
+                let meta_json = serde_json::to_string(meta)?;
+                kv.build_insert()
+                    .metadata(&meta_json)
+                    .execute(key, body.clone())?;
+
+                // Replace the cached copy too, so it reflects the new metadata
+                let mut w = cache::core::insert(key.to_string().into(), config::CACHE_TTL)
+                    .surrogate_keys(["get"])
+                    .user_metadata(meta_json.into_bytes().into())
+                    .execute()?;
+                w.write_all(&body)?;
+                w.finish()?;
+            }
+            meta
+        },
+        Err(_) => {
+            let (mime, _) = detect_mime(&body, filename);
+            let allowed = config::ALLOWED_MIME_TYPES.is_empty()
+                || config::ALLOWED_MIME_TYPES
+                    .iter()
+                    .any(|m| mime.starts_with(m));
+            if !allowed
+                || config::DENIED_MIME_TYPES
+                    .iter()
+                    .any(|m| mime.starts_with(m))
+            {
+                return Ok(error_response(
+                    &req,
+                    415,
+                    &format!("content type {mime} is not accepted"),
+                ));
             }
-        });
 
-        let meta = types::FileMetadata::new(hash.into(), mime);
+            // Smaller content is kept around for longer
+            let ttl = config::kv_ttl(body.len());
+            let now = SystemTime::now()
+                .duration_since(SystemTime::UNIX_EPOCH)
+                .unwrap_or_default();
+            let expires = (now + ttl).as_secs();
 
-        kv.build_insert()
-            .metadata(&serde_json::to_string(&meta).unwrap())
-            .time_to_live(config::KV_TTL)
-            .execute(key, body)?;
-        track_upload(&kv, id, filename.unwrap_or("undefined"))?;
-    }
+            // Enforce the daily upload quota for anonymous clients
+            if let Some(quota) = config::DAILY_UPLOAD_QUOTA.filter(|_| api_key.is_none()) {
+                if let Some(quota_key) = get_quota_key(&req, &kv, "quota") {
+                    let used = get_quota_usage(&kv, &quota_key) + body.len();
+                    if used > quota {
+                        return Ok(error_response(
+                            &req,
+                            429,
+                            &format!(
+                                "daily upload quota of {} exceeded, try again tomorrow",
+                                humanize_bytes_binary!(quota)
+                            ),
+                        ));
+                    }
+                    kv.build_insert()
+                        .time_to_live(Duration::from_secs(86400))
+                        .execute(&quota_key, used.to_string())?;
+                }
+            }
+
+            let mut meta = types::FileMetadata::new(hash.into(), mime, expires);
+            meta.reply_to = reply_to.map(str::to_string);
+            meta.license = license.map(str::to_string);
+            meta.language = language.map(str::to_string);
+            meta.tos_accepted = tos_accepted;
+            meta.uploader = api_key.as_ref().map(|k| k.name.clone());
+            meta.size = Some(body.len());
+            meta.created = Some(now.as_secs());
+            if keep {
+                meta.expires = None;
+            }
+
+            let mut insert = kv
+                .build_insert()
+                .metadata(&serde_json::to_string(&meta).unwrap());
+            if !keep {
+                insert = insert.time_to_live(ttl);
+            }
+            insert.execute(key, body)?;
+            track_upload(
+                &kv,
+                id,
+                filename.unwrap_or("undefined"),
+                &meta,
+                api_key.as_ref().map(|k| k.name.as_str()),
+            )?;
+
+            // List the paste publicly, if requested
+            if has_query_flag(&req, "public") {
+                kv.build_insert().mode(InsertMode::Append).execute(
+                    config::PUBLIC_PASTES_KEY,
+                    format!(
+                        "{:?} , {id} , {}\n",
+                        now.as_millis(),
+                        filename.unwrap_or_default()
+                    ),
+                )?;
+            }
+
+            // Link the parent paste back to this one. Each append resets the ttl of the list, so
+            // keep it for as long as the longer lived of the parent and this reply.
+            if let Some(parent) = reply_to {
+                let mut insert = kv.build_insert().mode(InsertMode::Append);
+                let list_expires = match parent_expires {
+                    // Permanent parent or reply
+                    Some(None) => None,
+                    _ if keep => None,
+                    Some(Some(parent)) => Some(parent.max(expires)),
+                    None => Some(expires),
+                };
+                if let Some(list_expires) = list_expires {
+                    insert = insert.time_to_live(Duration::from_secs(list_expires - now.as_secs()));
+                }
+                insert.execute(&format!("replies_{parent}"), format!("{id}\n"))?;
+            }
+            Some(meta)
+        },
+    };
 
     println!("put {key} in storage");
 
@@ -180,9 +690,549 @@ fn handle_put(mut req: Request) -> Result<Response, Error> {
     );
 
     // Respond with download URL
-    Ok(Response::from_body(url + "\n")
+    let mut res = Response::from_body(url + "\n")
         .with_content_type(mime::TEXT_PLAIN_UTF_8)
-        .with_header("x-origin-url", origin_url))
+        .with_header("x-origin-url", origin_url);
+    if let Some(expires) = meta.as_ref().and_then(|m| m.expires) {
+        let time = SystemTime::UNIX_EPOCH + Duration::from_secs(expires);
+        res.set_header("x-expires", format_rfc3339_seconds(time).to_string());
+    }
+    if let Some(license) = meta.as_ref().and_then(|m| m.license.as_ref()) {
+        res.set_header("x-license", license);
+    }
+    Ok(res)
+}
+
+/// Handle api requests
+#[inline(always)]
+fn handle_post(mut req: Request) -> Result<Response, Error> {
+    let url = req.get_url().clone();
+    let segments = url.path_segments().unwrap().collect::<Vec<_>>();
+    match segments.as_slice() {
+        // Guess the mime type of a snippet, optionally with a filename
+        ["api", "detect", rest @ ..] => {
+            let filename = rest.last().copied().filter(|v| !v.is_empty());
+            let mut body = Vec::new();
+            req.take_body()
+                .take(config::DETECT_MAX_SIZE as u64 + 1)
+                .read_to_end(&mut body)?;
+            if body.len() > config::DETECT_MAX_SIZE {
+                return Ok(error_response(&req, 413, "snippet too large"));
+            }
+            let (mime, mut confidence) = detect_mime(&body, filename);
+            let essence = mime.split(';').next().unwrap_or_default();
+            let mut extension = mime_guess::get_mime_extensions_str(essence)
+                .and_then(|e| e.first())
+                .copied();
+
+            // Plain text says nothing about the language, so guess it from the content
+            let mut language = None;
+            if essence == mime::TEXT_PLAIN.essence_str() {
+                if let Some((lang, ext, score)) =
+                    std::str::from_utf8(&body).ok().and_then(guess_language)
+                {
+                    language = Some(lang);
+                    extension = Some(ext);
+                    confidence = score;
+                }
+            }
+            let json = serde_json::to_string_pretty(&json!({
+                "mime": mime,
+                "extension": extension,
+                "language": language,
+                "confidence": confidence,
+            }))?;
+            Ok(Response::from_body(json).with_content_type(mime::APPLICATION_JSON))
+        },
+        // Flag a paste for review by the operator, with a reason as the body
+        ["report", id] => {
+            let kv = KVStore::open(config::KV_STORE)?.expect("kv store to exist");
+            if !is_valid_id(id) || kv.lookup(&format!("file_{id}")).is_err() {
+                return Ok(error_response(&req, 404, &format!("{id} not found")));
+            }
+            let body = req.take_body_bytes();
+            if body.len() > config::MAX_REPORT_SIZE {
+                return Ok(error_response(&req, 413, "reason too large"));
+            }
+            let reason = String::from_utf8_lossy(&body)
+                .split_whitespace()
+                .collect::<Vec<_>>()
+                .join(" ");
+            if reason.is_empty() {
+                return Ok(error_response(&req, 400, "missing report reason"));
+            }
+
+            // Limit reports per client, since they all append to a single key
+            let Some(quota_key) = get_quota_key(&req, &kv, "reports") else {
+                return Ok(error_response(&req, 400, "unable to identify client"));
+            };
+            let sent = get_quota_usage(&kv, &quota_key) + 1;
+            if sent > config::DAILY_REPORT_LIMIT {
+                return Ok(error_response(
+                    &req,
+                    429,
+                    "daily report limit exceeded, try again tomorrow",
+                ));
+            }
+            kv.build_insert()
+                .time_to_live(Duration::from_secs(86400))
+                .execute(&quota_key, sent.to_string())?;
+
+            kv.build_insert().mode(InsertMode::Append).execute(
+                config::REPORTS_KEY,
+                format!(
+                    "{:?} , {id} , {reason}\n",
+                    SystemTime::now()
+                        .duration_since(SystemTime::UNIX_EPOCH)
+                        .unwrap_or_default()
+                        .as_millis()
+                ),
+            )?;
+            println!("reported {id}");
+            Ok(Response::new().with_body_text_plain("reported, thank you\n"))
+        },
+        _ => Ok(error_response(&req, 404, "invalid request")),
+    }
+}
+
+/// Detect the mime type of some content, along with a rough confidence of the guess.
+#[inline(always)]
+fn detect_mime(body: &[u8], filename: Option<&str>) -> (String, f32) {
+    // try and detect mime type from magic byte sequences
+    if let Some(t) = infer::get(body) {
+        return (t.to_string(), 0.9);
+    }
+    // try to detect from the (optionally) given filename
+    if let Some(mime) = filename.and_then(|f| mime_guess::from_path(f).into_iter().next()) {
+        return (mime.to_string(), 0.7);
+    }
+    if std::str::from_utf8(body).is_ok() {
+        // if it's valid utf-8
+        (mime::TEXT_PLAIN_UTF_8.to_string(), 0.5)
+    } else {
+        // fallback to raw octet stream bytes
+        (mime::APPLICATION_OCTET_STREAM.to_string(), 0.1)
+    }
+}
+
+/// Guess the language of a text snippet from shebangs, markers, and common keywords. Returns the
+/// language, its file extension, and a confidence score.
+fn guess_language(text: &str) -> Option<(&'static str, &'static str, f32)> {
+    const SHEBANGS: &[(&str, &str, &str)] = &[
+        ("python", "python", "py"),
+        ("bash", "bash", "sh"),
+        ("zsh", "bash", "sh"),
+        ("sh", "bash", "sh"),
+        ("node", "javascript", "js"),
+        ("deno", "typescript", "ts"),
+        ("ruby", "ruby", "rb"),
+        ("perl", "perl", "pl"),
+        ("php", "php", "php"),
+        ("lua", "lua", "lua"),
+    ];
+    const KEYWORDS: &[(&str, &str, &[&str])] = &[
+        (
+            "rust",
+            "rs",
+            &[
+                "fn ",
+                "let mut ",
+                "impl ",
+                "pub fn ",
+                "use std::",
+                "-> ",
+                "#[derive",
+            ],
+        ),
+        (
+            "python",
+            "py",
+            &[
+                "def ", "import ", "elif ", "self.", "print(", "__init__", "None",
+            ],
+        ),
+        (
+            "javascript",
+            "js",
+            &[
+                "function ",
+                "const ",
+                "=> ",
+                "console.log",
+                "require(",
+                "export ",
+            ],
+        ),
+        (
+            "go",
+            "go",
+            &["package ", "func ", ":= ", "fmt.", "import (", "err != nil"],
+        ),
+        (
+            "c",
+            "c",
+            &["#include", "int main", "printf(", "void ", "NULL", "->"],
+        ),
+        (
+            "java",
+            "java",
+            &[
+                "public class",
+                "System.out",
+                "private ",
+                "static void",
+                "import java",
+            ],
+        ),
+        (
+            "bash",
+            "sh",
+            &["echo ", "fi\n", "then\n", "$(", "esac", "done\n"],
+        ),
+        (
+            "sql",
+            "sql",
+            &["SELECT ", "FROM ", "WHERE ", "INSERT INTO", "CREATE TABLE"],
+        ),
+        ("markdown", "md", &["# ", "```", "](", "**", "\n- "]),
+    ];
+
+    let trimmed = text.trim_start();
+    if let Some(line) = trimmed.lines().next().and_then(|l| l.strip_prefix("#!")) {
+        // `#!/usr/bin/env python3` and `#!/bin/python3` both name the interpreter last
+        let program = line.split_whitespace().last().unwrap_or_default();
+        let program = program.rsplit('/').next().unwrap_or_default();
+        if let Some((_, lang, ext)) = SHEBANGS.iter().find(|(p, _, _)| program.starts_with(p)) {
+            return Some((lang, ext, 0.9));
+        }
+    }
+    if trimmed.starts_with("<?php") {
+        return Some(("php", "php", 0.9));
+    }
+    if trimmed.starts_with(['{', '[']) && serde_json::from_str::<serde_json::Value>(text).is_ok() {
+        return Some(("json", "json", 0.9));
+    }
+    if trimmed.starts_with("<?xml") {
+        return Some(("xml", "xml", 0.8));
+    }
+    let lower = trimmed.get(..15).unwrap_or(trimmed).to_lowercase();
+    if lower.starts_with("<!doctype html") || lower.starts_with("<html") {
+        return Some(("html", "html", 0.8));
+    }
+
+    // Otherwise score by the number of distinct keywords found, requiring at least two
+    let (lang, ext, hits) = KEYWORDS
+        .iter()
+        .map(|(lang, ext, words)| {
+            (
+                lang,
+                ext,
+                words.iter().filter(|w| text.contains(*w)).count(),
+            )
+        })
+        .max_by_key(|(_, _, hits)| *hits)?;
+    (hits >= 2).then(|| (*lang, *ext, (0.3 + 0.1 * hits as f32).min(0.7)))
+}
+
+/// Strip exif, xmp, and text metadata from jpeg and png images. Returns none for other
+/// content, or an error if the image is malformed and metadata may remain.
+fn strip_metadata(body: &[u8]) -> Result<Option<Vec<u8>>, &'static str> {
+    const PNG_SIGNATURE: &[u8] = b"\x89PNG\r\n\x1a\n";
+    if body.starts_with(&[0xFF, 0xD8]) {
+        strip_jpeg(body).map(Some).ok_or("malformed jpeg image")
+    } else if body.starts_with(PNG_SIGNATURE) {
+        strip_png(body, PNG_SIGNATURE)
+            .map(Some)
+            .ok_or("malformed png image")
+    } else {
+        Ok(None)
+    }
+}
+
+/// Drop app1 (exif, xmp) and app13 (iptc) segments from a jpeg
+fn strip_jpeg(body: &[u8]) -> Option<Vec<u8>> {
+    let mut out = Vec::with_capacity(body.len());
+    out.extend_from_slice(&body[..2]);
+    let mut i = 2;
+    loop {
+        let marker = body.get(i..i + 2)?;
+        if marker[0] != 0xFF {
+            return None;
+        }
+        match marker[1] {
+            // Fill bytes may pad any marker
+            0xFF => i += 1,
+            // Standalone markers have no length
+            0x01 | 0xD0..=0xD7 => {
+                out.extend_from_slice(marker);
+                i += 2;
+            },
+            // Start of scan, the rest is entropy coded image data
+            0xDA => {
+                out.extend_from_slice(&body[i..]);
+                return Some(out);
+            },
+            // End of image without any scan, drop any trailing data
+            0xD9 => {
+                out.extend_from_slice(marker);
+                return Some(out);
+            },
+            kind => {
+                let len = u16::from_be_bytes(body.get(i + 2..i + 4)?.try_into().ok()?) as usize;
+                if len < 2 {
+                    return None;
+                }
+                let segment = body.get(i..i + 2 + len)?;
+                if !matches!(kind, 0xE1 | 0xED) {
+                    out.extend_from_slice(segment);
+                }
+                i += 2 + len;
+            },
+        }
+    }
+}
+
+/// Drop exif, text, and timestamp chunks from a png, along with any data after the end
+fn strip_png(body: &[u8], signature: &[u8]) -> Option<Vec<u8>> {
+    let mut out = Vec::with_capacity(body.len());
+    out.extend_from_slice(signature);
+    let mut i = signature.len();
+    loop {
+        let len = u32::from_be_bytes(body.get(i..i + 4)?.try_into().ok()?) as usize;
+        // length, type, data, and crc
+        // Checked, since usize is 32 bits on wasm and a crafted length would overflow
+        let end = len.checked_add(12).and_then(|n| i.checked_add(n))?;
+        let chunk = body.get(i..end)?;
+        match &chunk[4..8] {
+            b"eXIf" | b"tEXt" | b"zTXt" | b"iTXt" | b"tIME" => {},
+            b"IEND" => {
+                out.extend_from_slice(chunk);
+                return Some(out);
+            },
+            _ => out.extend_from_slice(chunk),
+        }
+        i += chunk.len();
+    }
+}
+
+/// Scan text for obvious credentials, returning the kinds of secrets found.
+#[inline(always)]
+fn detect_secrets(text: &str) -> Vec<&'static str> {
+    // Check if the prefix is followed by at least `len` token characters
+    let token = |prefix: &str, len: usize| {
+        text.match_indices(prefix).any(|(i, _)| {
+            text[i + prefix.len()..]
+                .chars()
+                .take_while(|c| c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '.'))
+                .count()
+                >= len
+        })
+    };
+
+    let mut found = Vec::new();
+    if text
+        .lines()
+        .any(|l| l.starts_with("-----BEGIN") && l.contains("PRIVATE KEY"))
+    {
+        found.push("private key");
+    }
+    if token("AKIA", 16) || token("ASIA", 16) {
+        found.push("aws access key");
+    }
+    if ["ghp_", "gho_", "ghs_", "ghu_", "github_pat_"]
+        .iter()
+        .any(|p| token(p, 30))
+    {
+        found.push("github token");
+    }
+    if ["xoxb-", "xoxp-", "xoxa-"].iter().any(|p| token(p, 20)) {
+        found.push("slack token");
+    }
+    if token("Bearer ", 20) {
+        found.push("bearer token");
+    }
+    found
+}
+
+/// Negotiate the response format for a client. Json must be explicitly accepted, command line
+/// clients (or clients without a user agent) get plain text, and everything else gets html.
+#[inline(always)]
+fn get_format(req: &Request) -> ResponseFormat {
+    const CLI_AGENTS: &[&str] = &["curl", "Wget", "HTTPie", "xh", "aria2", "PowerShell"];
+
+    let accept = req.get_header_str(header::ACCEPT).unwrap_or_default();
+    if accept.starts_with("application/json") {
+        return ResponseFormat::Json;
+    }
+    match req.get_header_str(header::USER_AGENT) {
+        Some(agent) if !agent.is_empty() && !CLI_AGENTS.iter().any(|a| agent.starts_with(a)) => {
+            ResponseFormat::Html
+        },
+        _ => ResponseFormat::Text,
+    }
+}
+
+/// Whether the client is a chat or social crawler fetching a link preview
+#[inline(always)]
+fn is_preview_bot(req: &Request) -> bool {
+    const PREVIEW_AGENTS: &[&str] = &[
+        "Slackbot",
+        "Discordbot",
+        "Twitterbot",
+        "facebookexternalhit",
+        "TelegramBot",
+        "WhatsApp",
+        "LinkedInBot",
+        "Mastodon",
+    ];
+
+    let agent = req.get_header_str(header::USER_AGENT).unwrap_or_default();
+    PREVIEW_AGENTS.iter().any(|a| agent.contains(a))
+}
+
+/// Build an error response in the format the client negotiated. Scripts in our own pages read
+/// error bodies as text, so html is only used for page navigations.
+#[inline(always)]
+fn error_response(req: &Request, status: u16, message: &str) -> Response {
+    let res = Response::from_status(status);
+    let accept = req.get_header_str(header::ACCEPT).unwrap_or_default();
+    match get_format(req) {
+        ResponseFormat::Json => res
+            .with_body(json!({ "status": status, "error": message }).to_string())
+            .with_content_type(mime::APPLICATION_JSON),
+        ResponseFormat::Html if accept.contains("text/html") => {
+            let html = format!(
+                include_str!("templates/error.html"),
+                host = get_host(req),
+                status = status,
+                message = htmlescape::encode_minimal(message)
+            );
+            res.with_body_text_html(&html)
+        },
+        ResponseFormat::Text | ResponseFormat::Html => {
+            res.with_body_text_plain(&format!("{message}\n"))
+        },
+    }
+}
+
+/// Characters in filenames that would break out of headers or paths
+const UNSAFE_FILENAME_CHARS: &[char] = &['/', '\\', '"'];
+
+/// Percent decode a filename from a url segment, rejecting names that are unsafe to use in
+/// headers or paths.
+#[inline(always)]
+fn decode_filename(segment: &str) -> Option<Cow<'_, str>> {
+    let name = urlencoding::decode(segment).ok()?;
+    let valid = !name.is_empty()
+        && name.len() <= 255
+        && name != "."
+        && name != ".."
+        && !name
+            .chars()
+            .any(|c| c.is_control() || UNSAFE_FILENAME_CHARS.contains(&c));
+    valid.then_some(name)
+}
+
+/// Percent decode a filename from a url segment, replacing any unsafe characters. Used for
+/// the cosmetic filenames given when downloading pastes, which are never stored.
+#[inline(always)]
+fn sanitize_filename(segment: &str) -> String {
+    let name = urlencoding::decode_binary(segment.as_bytes());
+    String::from_utf8_lossy(&name)
+        .chars()
+        .map(
+            |c| match c.is_control() || UNSAFE_FILENAME_CHARS.contains(&c) {
+                true => '_',
+                false => c,
+            },
+        )
+        .take(255)
+        .collect()
+}
+
+/// Check if a query parameter is present, with or without a value
+#[inline(always)]
+fn has_query_flag(req: &Request, name: &str) -> bool {
+    req.get_url().query_pairs().any(|(k, _)| k == name)
+}
+
+/// Get the host to use in generated links, preferring the configured canonical host.
+#[inline(always)]
+fn get_host(req: &Request) -> String {
+    match config::CANONICAL_HOST {
+        Some(host) => host.to_string(),
+        None => req.get_url().host().unwrap().to_string(),
+    }
+}
+
+/// Authenticate the api key given as a bearer token or `key` query param, if any.
+/// Unknown keys are rejected with an error response.
+#[inline(always)]
+fn get_api_key(req: &Request) -> Result<Option<types::ApiKey>, Response> {
+    let token = req
+        .get_header_str(header::AUTHORIZATION)
+        .and_then(|v| v.strip_prefix("Bearer "))
+        .or_else(|| req.get_query_parameter("key"));
+    let Some(token) = token else {
+        return Ok(None);
+    };
+
+    // Keys are stored hashed, so the config store never contains usable tokens
+    let hash = blake3::hash(token.trim().as_bytes()).to_hex().to_string();
+    fastly::ConfigStore::try_open(config::API_KEY_STORE)
+        .ok()
+        .and_then(|store| store.get(&hash))
+        .and_then(|v| serde_json::from_str(&v).ok())
+        .map(Some)
+        .ok_or_else(|| error_response(req, 401, "invalid api key"))
+}
+
+const PROQUINT_CONSONANTS: &[u8; 16] = b"bdfghjklmnprstvz";
+const PROQUINT_VOWELS: &[u8; 4] = b"aiou";
+
+/// Encode a content hash into a paste id
+#[inline(always)]
+fn encode_id(hash: &[u8; 32]) -> String {
+    match config::ID_ENCODING {
+        config::IdEncoding::Base58 => {
+            let base = bs58::encode(hash).into_string();
+            base[..config::ID_SIZE].to_string()
+        },
+        config::IdEncoding::Proquint { words } => hash
+            .chunks(2)
+            .take(words)
+            .map(|c| {
+                let w = u16::from_be_bytes([c[0], c[1]]);
+                let con = |shift: u16| PROQUINT_CONSONANTS[(w >> shift & 15) as usize] as char;
+                let vow = |shift: u16| PROQUINT_VOWELS[(w >> shift & 3) as usize] as char;
+                [con(12), vow(10), con(6), vow(4), con(0)]
+                    .iter()
+                    .collect::<String>()
+            })
+            .collect::<Vec<_>>()
+            .join("-"),
+    }
+}
+
+/// Check if a string is a well formed paste id
+#[inline(always)]
+fn is_valid_id(id: &str) -> bool {
+    match config::ID_ENCODING {
+        config::IdEncoding::Base58 => {
+            id.len() == config::ID_SIZE && bs58::decode(id).into_vec().is_ok()
+        },
+        config::IdEncoding::Proquint { words } => {
+            let parts = id.split('-').collect::<Vec<_>>();
+            parts.len() == words
+                && parts.iter().all(|p| {
+                    p.len() == 5
+                        && p.bytes().enumerate().all(|(i, b)| match i % 2 {
+                            0 => PROQUINT_CONSONANTS.contains(&b),
+                            _ => PROQUINT_VOWELS.contains(&b),
+                        })
+                })
+        },
+    }
 }
 
 /// Get upload count from the metadata, or fallback to the number of metric lines.
@@ -200,9 +1250,95 @@ fn get_upload_count(kv: &KVStore) -> usize {
         .unwrap_or_default()
 }
 
-/// Append the key and a timestamp to the metrics
+/// Get the key tracking a client's usage (ie, uploaded bytes or reports) for the current day.
+/// Ipv6 clients are grouped by their /64 prefix, since they can trivially rotate the rest of the
+/// address. Addresses are never stored, only a keyed hash of them that rotates daily.
+#[inline(always)]
+fn get_quota_key(req: &Request, kv: &KVStore, prefix: &str) -> Option<String> {
+    let ip = match req.get_client_ip_addr()? {
+        IpAddr::V4(ip) => ip.to_string(),
+        IpAddr::V6(ip) => {
+            let s = ip.segments();
+            format!("{:x}:{:x}:{:x}:{:x}::/64", s[0], s[1], s[2], s[3])
+        },
+    };
+    let day = SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_secs()
+        / 86400;
+    let hash = blake3::keyed_hash(&get_quota_secret(kv)?, format!("{day} {ip}").as_bytes());
+    Some(format!("{prefix}_{day}_{}", &hash.to_hex()[..32]))
+}
+
+/// Get the random secret for hashing client addresses, generating it on first use
+#[inline(always)]
+fn get_quota_secret(kv: &KVStore) -> Option<[u8; 32]> {
+    if let Ok(mut res) = kv.lookup(config::QUOTA_SECRET_KEY) {
+        return res.take_body_bytes().try_into().ok();
+    }
+    let secret = rand::random::<[u8; 32]>();
+    match kv
+        .build_insert()
+        .mode(InsertMode::Add)
+        .execute(config::QUOTA_SECRET_KEY, secret.to_vec())
+    {
+        Ok(()) => Some(secret),
+        // Another request created the secret first
+        Err(_) => kv
+            .lookup(config::QUOTA_SECRET_KEY)
+            .ok()?
+            .take_body_bytes()
+            .try_into()
+            .ok(),
+    }
+}
+
+/// Get the most recent public pastes that are still guaranteed to be stored, newest first
+#[inline(always)]
+fn get_recent() -> Result<Vec<(SystemTime, String, Option<String>)>, Error> {
+    let kv = KVStore::open(config::KV_STORE)?.expect("kv store to exist");
+    let Ok(mut res) = kv.lookup(config::PUBLIC_PASTES_KEY) else {
+        return Ok(Vec::new());
+    };
+    let cutoff = SystemTime::now() - config::KV_MIN_TTL;
+    let mut recent = res
+        .take_body_bytes()
+        .lines()
+        .map_while(Result::ok)
+        .filter_map(|line| {
+            let mut parts = line.splitn(3, " , ");
+            let millis = parts.next()?.parse().ok()?;
+            let time = SystemTime::UNIX_EPOCH + Duration::from_millis(millis);
+            let id = parts.next()?.to_string();
+            let filename = parts.next().filter(|f| !f.is_empty()).map(str::to_string);
+            (time > cutoff).then_some((time, id, filename))
+        })
+        .collect::<Vec<_>>();
+    recent.reverse();
+    recent.truncate(config::RECENT_PASTES);
+    Ok(recent)
+}
+
+/// Get the usage (ie, bytes uploaded or reports sent) counted under a quota key
+#[inline(always)]
+fn get_quota_usage(kv: &KVStore, key: &str) -> usize {
+    kv.lookup(key)
+        .ok()
+        .and_then(|mut v| String::from_utf8_lossy(&v.take_body_bytes()).parse().ok())
+        .unwrap_or_default()
+}
+
+/// Append the key and a timestamp to the metrics, along with the size, type, and api key name
+/// if one was used
 #[inline(always)]
-fn track_upload(kv: &KVStore, id: &str, file: &str) -> Result<(), Error> {
+fn track_upload(
+    kv: &KVStore,
+    id: &str,
+    file: &str,
+    meta: &FileMetadata,
+    api_key: Option<&str>,
+) -> Result<(), Error> {
     let new_count = get_upload_count(kv) + 1;
     kv.build_insert()
         .mode(InsertMode::Append)
@@ -210,11 +1346,14 @@ fn track_upload(kv: &KVStore, id: &str, file: &str) -> Result<(), Error> {
         .execute(
             config::UPLOAD_METRICS_KEY,
             format!(
-                "{:?} , {id} , {file}\n",
+                "{:?} , {id} , {file} , size:{} , mime:{}{}\n",
                 SystemTime::now()
                     .duration_since(SystemTime::UNIX_EPOCH)
                     .unwrap_or_default()
-                    .as_millis()
+                    .as_millis(),
+                meta.size.unwrap_or_default(),
+                meta.mime(),
+                api_key.map(|k| format!(" , key:{k}")).unwrap_or_default()
             ),
         )?;
     Ok(())
@@ -224,26 +1363,38 @@ fn track_upload(kv: &KVStore, id: &str, file: &str) -> Result<(), Error> {
 #[inline(always)]
 fn handle_get(req: Request, nonce: usize) -> Result<Response, Error> {
     let url = req.get_url();
-    let host = url.host().unwrap().to_string();
+    let host = get_host(&req);
     let mut segments = url.path_segments().unwrap();
     match segments.next() {
         // Usage page
         Some("") => {
-            // For all other clients other than curl, wrap with html (ie, browsers)
-            if let Some(agent) = req.get_header_str("user-agent") {
-                if !(agent.starts_with("curl") || agent.starts_with("Wget")) {
-                    let usage = get_usage(&host, true)?;
-                    let html = format!(
-                        include_str!("templates/index.html"),
-                        host = host,
-                        body = htmlescape::encode_minimal(&String::from_utf8_lossy(
-                            &usage.into_bytes()
-                        )),
-                        nonce = nonce
-                    );
+            match config::LANDING_PAGE {
+                config::LandingPage::Interactive => {},
+                config::LandingPage::Text => {
+                    let usage = get_usage(&host, false)?;
+                    return Ok(Response::new().with_body_text_plain(&usage));
+                },
+                config::LandingPage::Custom(html) => {
+                    return Ok(Response::new().with_body_text_html(html));
+                },
+                config::LandingPage::Disabled => {
+                    return Ok(error_response(&req, 404, "not found"));
+                },
+            }
 
-                    return Ok(Response::new().with_body_text_html(&html));
-                }
+            // For all clients other than command line tools, wrap with html (ie, browsers)
+            if get_format(&req) == ResponseFormat::Html {
+                let usage = get_usage(&host, true)?;
+                let html = format!(
+                    include_str!("templates/index.html"),
+                    host = host,
+                    tos_required = config::REQUIRE_TOS,
+                    body =
+                        htmlescape::encode_minimal(&String::from_utf8_lossy(&usage.into_bytes())),
+                    nonce = nonce
+                );
+
+                return Ok(Response::new().with_body_text_html(&html));
             }
 
             let usage = get_usage(&host, false)?;
@@ -254,16 +1405,14 @@ fn handle_get(req: Request, nonce: usize) -> Result<Response, Error> {
         Some("privacy") => {
             const PRIVACY: &str = include_str!("static/privacy.txt");
 
-            // For all other clients other than curl, wrap with html (ie, browsers)
-            if let Some(agent) = req.get_header_str("user-agent") {
-                if !agent.starts_with("curl") {
-                    let html = format!(
-                        include_str!("templates/privacy.html"),
-                        host = host,
-                        body = PRIVACY
-                    );
-                    return Ok(Response::new().with_body_text_html(&html));
-                }
+            // For all clients other than command line tools, wrap with html (ie, browsers)
+            if get_format(&req) == ResponseFormat::Html {
+                let html = format!(
+                    include_str!("templates/privacy.html"),
+                    host = host,
+                    body = PRIVACY
+                );
+                return Ok(Response::new().with_body_text_html(&html));
             }
 
             Ok(Response::new().with_body_text_plain(PRIVACY))
@@ -281,66 +1430,600 @@ fn handle_get(req: Request, nonce: usize) -> Result<Response, Error> {
             Ok(Response::from_body(FAVICON).with_content_type(mime::IMAGE_PNG))
         },
 
-        // JSON information page
-        Some("json") => {
-            let kv = KVStore::open(config::KV_STORE)?.unwrap();
-            let cnt = get_upload_count(&kv);
-            let json = serde_json::to_string_pretty(&json!({
-                "uploads": cnt,
-                "id_size": config::ID_SIZE,
-                "kv_ttl": format_duration(config::KV_TTL).to_string(),
-                "cache_ttl": format_duration(config::CACHE_TTL).to_string()
-            }))?;
-            Ok(Response::from_body(json).with_content_type(mime::APPLICATION_JSON))
+        // Server statistics page
+        Some("stats") => {
+            let stats = get_stats()?;
+
+            // For all clients other than command line tools, wrap with html (ie, browsers)
+            if get_format(&req) == ResponseFormat::Html {
+                let html = format!(
+                    include_str!("templates/stats.html"),
+                    host = host,
+                    body = htmlescape::encode_minimal(&stats)
+                );
+                return Ok(Response::new().with_body_text_html(&html));
+            }
+
+            Ok(Response::new().with_body_text_plain(&stats))
         },
 
-        // Paste download
-        Some("p") => {
-            let Some(id) = segments.next() else {
-                return Ok(Response::from_status(404).with_body_text_plain("expected paste id"));
-            };
-            let is_markdown = req.get_query_str() == Some("md");
-
-            let last = segments.next_back();
-            let filename = last.unwrap_or({
-                if !is_markdown {
-                    "no bs pastebin"
-                } else {
-                    "no bs markdown"
-                }
-            });
+        // Recently uploaded public pastes
+        Some("recent") => {
+            let recent = get_recent()?;
+            if get_format(&req) == ResponseFormat::Json {
+                let json = serde_json::to_string_pretty(&json!(
+                    recent
+                        .iter()
+                        .map(|(time, id, filename)| json!({
+                            "id": id,
+                            "filename": filename,
+                            "created": format_rfc3339_seconds(*time).to_string(),
+                        }))
+                        .collect::<Vec<_>>()
+                ))?;
+                return Ok(Response::from_body(json).with_content_type(mime::APPLICATION_JSON));
+            }
+            let mut text = String::new();
+            let mut html = String::new();
+            for (time, id, filename) in &recent {
+                let url = format!(
+                    "https://{host}/p/{id}{}",
+                    filename
+                        .as_deref()
+                        .map(|f| "/".to_string() + f)
+                        .unwrap_or_default()
+                );
+                let time = &format_rfc3339_seconds(*time).to_string()[..10];
+                text += &format!("{time}  {url}\n");
+                html += &format!(
+                    "{time}  <a href=\"{}\">{}</a>\n",
+                    htmlescape::encode_attribute(&url),
+                    htmlescape::encode_minimal(filename.as_deref().unwrap_or(id))
+                );
+            }
+            if recent.is_empty() {
+                text = "No public pastes yet, upload with ?public to list one here\n".into();
+                html = htmlescape::encode_minimal(&text);
+            }
 
-            let Ok((content, meta)) = get_paste(id, is_markdown, &host, filename) else {
-                return Ok(
-                    Response::from_status(404).with_body_text_plain(&format!("{id} not found"))
+            // For all clients other than command line tools, wrap with html (ie, browsers)
+            if get_format(&req) == ResponseFormat::Html {
+                let html = format!(
+                    include_str!("templates/recent.html"),
+                    host = host,
+                    body = html
                 );
+                return Ok(Response::new().with_body_text_html(&html));
+            }
+
+            Ok(Response::new().with_body_text_plain(&text))
+        },
+
+        // Atom feed of recently uploaded public pastes
+        Some("feed.atom") => {
+            let recent = get_recent()?;
+            let updated = recent.first().map_or(SystemTime::UNIX_EPOCH, |(t, ..)| *t);
+            let mut feed = format!(
+                concat!(
+                    r#"<?xml version="1.0" encoding="utf-8"?>"#,
+                    "\n",
+                    r#"<feed xmlns="http://www.w3.org/2005/Atom">"#,
+                    "\n  <title>{host} public pastes</title>",
+                    "\n  <id>https://{host}/recent</id>",
+                    "\n",
+                    r#"  <link href="https://{host}/recent"/>"#,
+                    "\n",
+                    r#"  <link rel="self" href="https://{host}/feed.atom"/>"#,
+                    "\n  <updated>{updated}</updated>\n"
+                ),
+                host = host,
+                updated = format_rfc3339_seconds(updated)
+            );
+            for (time, id, filename) in &recent {
+                let url = format!(
+                    "https://{host}/p/{id}{}",
+                    filename
+                        .as_deref()
+                        .map(|f| "/".to_string() + f)
+                        .unwrap_or_default()
+                );
+                feed += &format!(
+                    concat!(
+                        "  <entry>\n",
+                        "    <title>{title}</title>\n",
+                        "    <id>https://{host}/p/{id}</id>\n",
+                        "    <link href=\"{url}\"/>\n",
+                        "    <author><name>anonymous</name></author>\n",
+                        "    <updated>{updated}</updated>\n",
+                        "  </entry>\n"
+                    ),
+                    title = htmlescape::encode_minimal(filename.as_deref().unwrap_or(id)),
+                    host = host,
+                    id = id,
+                    url = htmlescape::encode_attribute(&url),
+                    updated = format_rfc3339_seconds(*time)
+                );
+            }
+            feed += "</feed>\n";
+            Ok(Response::from_body(feed)
+                .with_content_type("application/atom+xml".parse::<mime::Mime>().unwrap())
+                .with_header(header::CACHE_CONTROL, "public, max-age=300"))
+        },
+
+        // Client side encrypted pastes, where the key never leaves the browser
+        Some("e") => {
+            let id = segments.next().unwrap_or_default();
+            if !id.is_empty() && !is_valid_id(id) {
+                return Ok(error_response(&req, 404, "expected paste id"));
+            }
+            let html = format!(
+                include_str!("templates/encrypted.html"),
+                host = host,
+                id = id,
+                tos_required = config::REQUIRE_TOS,
+                nonce = nonce
+            );
+            Ok(Response::new().with_body_text_html(&html))
+        },
+
+        // Vendored static assets, ie the katex and mermaid scripts for rendered markdown
+        Some("static") => {
+            let path = segments.collect::<Vec<_>>();
+            let valid = !path.is_empty()
+                && path.iter().all(|p| {
+                    !p.is_empty()
+                        && !p.starts_with('.')
+                        && p.chars().all(|c| {
+                            c.is_ascii_alphanumeric() || matches!(c, '.' | '-' | '_' | '@')
+                        })
+                });
+            let kv = KVStore::open(config::KV_STORE)?.expect("kv store to exist");
+            let path = path.join("/");
+            let found = valid
+                .then(|| {
+                    kv.lookup(&format!("{}{path}", config::STATIC_ASSET_PREFIX))
+                        .ok()
+                })
+                .flatten();
+            let Some(mut found) = found else {
+                return Ok(error_response(&req, 404, &format!("{path} not found")));
+            };
+            let mime = mime_guess::from_path(&path).first_or_octet_stream();
+            Ok(Response::from_body(found.take_body())
+                .with_content_type(mime)
+                // Asset paths are versioned, so they never change
+                .with_header(header::CACHE_CONTROL, "public, max-age=31536000, immutable"))
+        },
+
+        // Exit page for external links in rendered content
+        Some("exit") => {
+            let target = url
+                .query_pairs()
+                .find_map(|(k, v)| (k == "url").then_some(v))
+                .filter(|v| v.starts_with("https://") || v.starts_with("http://"));
+            let Some(target) = target else {
+                return Ok(error_response(&req, 400, "invalid exit url"));
             };
 
-            Ok(Response::from_body(content)
-                // Immutable client caching
+            let html = format!(
+                include_str!("templates/exit.html"),
+                host = host,
+                url = htmlescape::encode_attribute(&target),
+            );
+            Ok(Response::new().with_body_text_html(&html))
+        },
+
+        // ShareX custom uploader config
+        Some("sharex.sxcu") => {
+            let json = serde_json::to_string_pretty(&json!({
+                "Version": "14.0.0",
+                "Name": host,
+                "DestinationType": "ImageUploader, TextUploader, FileUploader",
+                "RequestMethod": "PUT",
+                "RequestURL": format!("https://{host}/{{filename}}"),
+                "Body": "Binary",
+                "URL": "{response}",
+            }))?;
+            Ok(Response::from_body(json)
+                .with_content_type(mime::APPLICATION_JSON)
                 .with_header(
-                    // Client-side cache control, content will never change
+                    header::CONTENT_DISPOSITION,
+                    format!(r#"attachment; filename="{host}.sxcu""#),
+                ))
+        },
+
+        // JSON information page
+        Some("json") => {
+            let kv = KVStore::open(config::KV_STORE)?.unwrap();
+            let cnt = get_upload_count(&kv);
+            let json = serde_json::to_string_pretty(&json!({
+                "uploads": cnt,
+                "id_size": config::ID_SIZE,
+                // Kept for existing clients, from before ttls depended on the size
+                "kv_ttl": format_duration(config::KV_MAX_TTL).to_string(),
+                "kv_min_ttl": format_duration(config::KV_MIN_TTL).to_string(),
+                "kv_max_ttl": format_duration(config::KV_MAX_TTL).to_string(),
+                "cache_ttl": format_duration(config::CACHE_TTL).to_string()
+            }))?;
+            Ok(Response::from_body(json).with_content_type(mime::APPLICATION_JSON))
+        },
+
+        // oEmbed metadata for paste links, used by chat clients to unfurl them
+        Some("oembed") => {
+            let url = req.get_query_parameter("url").unwrap_or_default();
+            let path = url.split(['?', '#']).next().unwrap_or_default();
+            let prefix = format!("https://{host}/");
+            let mut parts = path.strip_prefix(&prefix).unwrap_or_default().split('/');
+            let title = match (parts.next(), parts.next(), parts.next()) {
+                (Some("p"), Some(id), filename) if is_valid_id(id) => filename
+                    .filter(|f| !f.is_empty())
+                    .map(|f| {
+                        urlencoding::decode(f)
+                            .map(|f| f.to_string())
+                            .unwrap_or_default()
+                    })
+                    .unwrap_or(id.to_string()),
+                (Some("diff"), Some(a), Some(b)) => format!("{a}..{b}"),
+                _ => {
+                    return Ok(error_response(
+                        &req,
+                        404,
+                        "expected a paste url from this host",
+                    ));
+                },
+            };
+            let json = serde_json::to_string_pretty(&json!({
+                "version": "1.0",
+                "type": "link",
+                "title": title,
+                "provider_name": host,
+                "provider_url": prefix,
+                "cache_age": config::CACHE_TTL.as_secs()
+            }))?;
+            Ok(Response::from_body(json).with_content_type(mime::APPLICATION_JSON))
+        },
+
+        // Unified diff between two pastes
+        Some("diff") => {
+            let (Some(a), Some(b)) = (segments.next(), segments.next()) else {
+                return Ok(error_response(&req, 404, "expected two paste ids"));
+            };
+
+            let mut contents = Vec::with_capacity(2);
+            for id in [a, b] {
+                let Ok((content, meta, _)) = get_paste(id, None, &host, id, nonce) else {
+                    return Ok(error_response(&req, 404, &format!("{id} not found")));
+                };
+                if !meta.mime().starts_with("text/") {
+                    return Ok(error_response(
+                        &req,
+                        415,
+                        &format!("{id} is not a text paste"),
+                    ));
+                }
+                let mut buf = Vec::new();
+                fastly::Body::from(content)
+                    .take(config::DIFF_MAX_SIZE as u64 + 1)
+                    .read_to_end(&mut buf)?;
+                if buf.len() > config::DIFF_MAX_SIZE {
+                    return Ok(error_response(
+                        &req,
+                        413,
+                        &format!("{id} is too large to diff"),
+                    ));
+                }
+                contents.push(String::from_utf8_lossy(&buf).to_string());
+            }
+            let diff = similar::TextDiff::configure()
+                .timeout(config::DIFF_TIMEOUT)
+                .diff_lines(contents[0].as_str(), contents[1].as_str())
+                .unified_diff()
+                .header(a, b)
+                .to_string();
+
+            // For all clients other than command line tools, render highlighted html (ie, browsers)
+            if get_format(&req) == ResponseFormat::Html {
+                let lines = diff
+                    .lines()
+                    .map(|l| {
+                        let line = htmlescape::encode_minimal(l);
+                        let color = match l.chars().next() {
+                            Some('+') => "#3fb950",
+                            Some('-') => "#f85149",
+                            Some('@') => "#d2a8ff",
+                            _ => return line,
+                        };
+                        format!(r#"<span style="color: {color}">{line}</span>"#)
+                    })
+                    .collect::<Vec<_>>();
+                let html = format!(
+                    include_str!("templates/markdown.html"),
+                    filename = format!("{a}..{b}"),
+                    description = format!("Diff between {a} and {b}"),
+                    url = format!("https://{host}/diff/{a}/{b}"),
+                    oembed = urlencoding::encode(&format!("https://{host}/diff/{a}/{b}")),
+                    lang = "",
+                    host = host,
+                    related = "",
+                    scripts = "",
+                    content = format!("<pre><code>{}</code></pre>", lines.join("\n"))
+                );
+                return Ok(Response::new().with_body_text_html(&html));
+            }
+
+            Ok(Response::new().with_body_text_plain(&diff))
+        },
+
+        // Embeddable paste view, and the script to embed it from other pages
+        Some("embed") => {
+            let Some(last) = segments.next() else {
+                return Ok(error_response(&req, 404, "expected paste id"));
+            };
+            let (id, is_script) = match last.strip_suffix(".js") {
+                Some(id) => (id, true),
+                None => (last, false),
+            };
+
+            // Only the metadata is needed to check the paste, and for binary content
+            let Ok((meta, _, _)) = get_paste_meta(id) else {
+                return Ok(error_response(&req, 404, &format!("{id} not found")));
+            };
+
+            if is_script {
+                let js = format!(include_str!("templates/embed.js"), host = host, id = id);
+                return Ok(Response::from_body(js)
+                    .with_content_type(mime::APPLICATION_JAVASCRIPT_UTF_8)
+                    .with_header(header::CACHE_CONTROL, "public, max-age=86400"));
+            }
+
+            let body = if meta.mime().starts_with("text/") {
+                let Ok((content, _, _)) = get_paste(id, None, &host, id, nonce) else {
+                    return Ok(error_response(&req, 404, &format!("{id} not found")));
+                };
+                // Embed the start of large pastes, linking to the rest
+                let mut bytes = Vec::new();
+                fastly::Body::from(content)
+                    .take(config::PREVIEW_MAX_SIZE + 1)
+                    .read_to_end(&mut bytes)?;
+                let truncated = bytes.len() as u64 > config::PREVIEW_MAX_SIZE;
+                bytes.truncate(config::PREVIEW_MAX_SIZE as usize);
+                let mut body = htmlescape::encode_minimal(&String::from_utf8_lossy(&bytes));
+                if truncated {
+                    body += &format!(
+                        r#"
+...
+
+<a href="https://{host}/p/{id}" target="_blank" rel="noopener">view full paste</a>"#
+                    );
+                }
+                body
+            } else {
+                format!("binary content ({})", meta.mime())
+            };
+            let html = format!(
+                include_str!("templates/embed.html"),
+                host = host,
+                id = id,
+                body = body,
+                nonce = nonce
+            );
+            Ok(Response::new().with_body_text_html(&html))
+        },
+
+        // Qr code of a paste url, for moving links from a terminal to a phone
+        Some("qr") => {
+            let id = segments.next().unwrap_or_default();
+            let (id, svg) = match id.strip_suffix(".svg") {
+                Some(id) => (id, true),
+                None => (id, false),
+            };
+            if !is_valid_id(id) {
+                return Ok(error_response(&req, 404, "expected paste id"));
+            }
+            get_qr_code(&format!("https://{host}/p/{id}"), &req, svg)
+        },
+
+        // Paste download
+        Some("p") => {
+            let Some(id) = segments.next() else {
+                return Ok(error_response(&req, 404, "expected paste id"));
+            };
+            if let Some(reason) = get_takedown(id) {
+                return Ok(error_response(
+                    &req,
+                    451,
+                    &format!("{id} was removed: {reason}"),
+                ));
+            }
+            if has_query_flag(&req, "qr") {
+                if !is_valid_id(id) {
+                    return Ok(error_response(&req, 404, "expected paste id"));
+                }
+                return get_qr_code(&format!("https://{host}/p/{id}"), &req, false);
+            }
+
+            // Preview the first lines of a text paste, without downloading all of it
+            if let Some(head) = req.get_query_parameter("head") {
+                let Ok(lines) = head.parse::<usize>() else {
+                    return Ok(error_response(&req, 400, "invalid line count"));
+                };
+                let Ok((content, meta, _)) = get_paste(id, None, &host, id, nonce) else {
+                    return Ok(error_response(&req, 404, &format!("{id} not found")));
+                };
+                if !meta.mime().starts_with("text/") {
+                    return Ok(error_response(
+                        &req,
+                        415,
+                        "previews are only available for text pastes",
+                    ));
+                }
+                let body = fastly::Body::from(content).take(config::PREVIEW_MAX_SIZE);
+                let preview = std::io::BufReader::new(body)
+                    .lines()
+                    .map_while(Result::ok)
+                    .take(lines)
+                    .fold(String::new(), |acc, line| acc + &line + "\n");
+                return Ok(Response::new()
+                    .with_header(
+                        header::CACHE_CONTROL,
+                        "public, s-maxage=31536000, immutable",
+                    )
+                    .with_body_text_plain(&preview));
+            }
+
+            let last = segments
+                .next_back()
+                .filter(|v| !v.is_empty())
+                .map(sanitize_filename);
+            let renderer = Renderer::from_request(req.get_query_str(), last.as_deref());
+            let filename = last
+                .as_deref()
+                .unwrap_or(renderer.map_or("no bs pastebin", |r| r.title()));
+
+            // Head requests for raw content only need the metadata, so skip fetching the body
+            let head = req.get_method() == Method::HEAD && renderer.is_none();
+            let paste = if head {
+                get_paste_meta(id).map(|(meta, len, cached)| {
+                    (fastly::Body::new().into_handle(), meta, cached, len)
+                })
+            } else {
+                get_paste(id, renderer, &host, filename, nonce)
+                    .map(|(content, meta, cached)| (content, meta, cached, None))
+            };
+            let Ok((content, meta, cached, cached_len)) = paste else {
+                return Ok(error_response(&req, 404, &format!("{id} not found")));
+            };
+
+            // Raw text has no markup to unfurl, so give link preview crawlers a stub page
+            if renderer.is_none()
+                && !head
+                && is_preview_bot(&req)
+                && meta.mime().starts_with("text/")
+            {
+                let text = std::io::read_to_string(
+                    fastly::Body::from(content).take(config::PREVIEW_MAX_SIZE),
+                )
+                .unwrap_or_default();
+                let url = format!("https://{host}/p/{id}");
+                let html = format!(
+                    include_str!("templates/preview.html"),
+                    filename = htmlescape::encode_attribute(&last.unwrap_or(id.to_string())),
+                    description = get_description(&htmlescape::encode_minimal(&text)),
+                    oembed = urlencoding::encode(&url),
+                    url = url,
+                    host = host
+                );
+                return Ok(Response::new()
+                    .with_header(header::CACHE_CONTROL, "private, max-age=300")
+                    .with_header(header::VARY, "user-agent")
+                    .with_body_text_html(&html));
+            }
+
+            // Svg scripts only run when the image is opened directly, so download it instead
+            let disposition = if config::SVG_ATTACHMENT
+                && renderer.is_none()
+                && meta.mime().starts_with("image/svg")
+                && !has_query_flag(&req, "raw")
+            {
+                "attachment"
+            } else {
+                "inline"
+            };
+
+            // Raw content is immutable, so the hash identifies the response. Rendered pages also
+            // link to replies, which can be added at any time, so they are only cached briefly.
+            let mut res = Response::from_body(content);
+            if renderer.is_none() {
+                let etag = format!(
+                    r#""{}""#,
+                    base64::engine::general_purpose::STANDARD.encode(meta.hash)
+                );
+                if req.get_header_str(header::IF_NONE_MATCH) == Some(&etag) {
+                    return Ok(Response::from_status(304).with_header(header::ETAG, etag));
+                }
+                res.set_header(header::ETAG, etag);
+                // Client-side cache control, content will never change
+                res.set_header(
                     header::CACHE_CONTROL,
                     "public, s-maxage=31536000, immutable",
-                )
+                );
+            } else {
+                res.set_header(header::CACHE_CONTROL, "public, max-age=300");
+            }
+            if let Some(expires) = meta.expires {
+                let time = SystemTime::UNIX_EPOCH + Duration::from_secs(expires);
+                res.set_header("x-expires", format_rfc3339_seconds(time).to_string());
+            }
+            if let Some(created) = meta.created {
+                let time = SystemTime::UNIX_EPOCH + Duration::from_secs(created);
+                res.set_header("x-created", format_rfc3339_seconds(time).to_string());
+            }
+            // Bodies are omitted for head requests, so advertise the size of the raw content. Older
+            // pastes have no size in their metadata, so fall back to the cached length.
+            if head {
+                if let Some(size) = meta.size.map(|s| s as u64).or(cached_len) {
+                    res.set_header(header::CONTENT_LENGTH, size.to_string());
+                }
+            }
+            // Expose cache status, for measuring hit rates from logs and clients
+            res.set_header("x-cache", if cached { "HIT" } else { "MISS" });
+            if let Some(parent) = &meta.reply_to {
+                res.set_header("x-reply-to", format!("https://{host}/p/{parent}"));
+            }
+            if let Some(license) = &meta.license {
+                res.set_header("x-license", license);
+            }
+            if let Some(language) = &meta.language {
+                res.set_header(header::CONTENT_LANGUAGE, language);
+            }
+
+            Ok(res
                 // Content type and disposition (for "filename" on certain browsers)
                 .with_header(header::CONTENT_TYPE, meta.mime())
                 // Some browsers will set the title to this header
                 .with_header(
                     header::CONTENT_DISPOSITION,
                     format!(
-                        r#"inline; filename="{filename}"; filename*=UTF-8''{}"#,
+                        r#"{disposition}; filename="{}"; filename*=UTF-8''{}"#,
+                        filename.replace(|c: char| !c.is_ascii(), "_"),
                         urlencoding::encode(filename)
                     ),
                 ))
         },
 
         // Unknown path
-        Some(p) => Ok(Response::from_status(404).with_body_text_plain(&format!("{p} not found"))),
+        Some(p) => Ok(error_response(&req, 404, &format!("{p} not found"))),
         None => unreachable!(),
     }
 }
 
+/// Render a qr code of a url, as an svg image for browsers (or if forced) or unicode blocks for
+/// terminals
+#[inline(always)]
+fn get_qr_code(url: &str, req: &Request, svg: bool) -> Result<Response, Error> {
+    let Ok(code) = qrcode::QrCode::new(url) else {
+        return Ok(error_response(req, 400, "url too long for a qr code"));
+    };
+    let res =
+        Response::new().with_header(header::CACHE_CONTROL, "public, max-age=31536000, immutable");
+
+    if svg || get_format(req) == ResponseFormat::Html {
+        let svg = code
+            .render::<qrcode::render::svg::Color>()
+            .min_dimensions(256, 256)
+            .build();
+        return Ok(res.with_body(svg).with_content_type(mime::IMAGE_SVG));
+    }
+
+    // Inverted colors, for dark terminal backgrounds
+    let text = code
+        .render::<qrcode::render::unicode::Dense1x2>()
+        .dark_color(qrcode::render::unicode::Dense1x2::Light)
+        .light_color(qrcode::render::unicode::Dense1x2::Dark)
+        .build();
+    Ok(res.with_body_text_plain(&(text + "\n")))
+}
+
 /// Handle a request to the usage page
 #[inline(always)]
 fn get_usage(host: &str, is_browser: bool) -> Result<String, Error> {
@@ -375,36 +2058,168 @@ fn get_usage(host: &str, is_browser: bool) -> Result<String, Error> {
         header = header,
         host = host,
         extra_usage = if is_browser {
-            "     * Web browser    :  Press <Ctrl/Cmd + V>\n"
+            "     * Web browser    :  Press <Ctrl/Cmd + V>, or drop files\n"
         } else {
             ""
         },
         max_size = humanize_bytes_binary!(config::MAX_CONTENT_SIZE),
-        kv_ttl = format_duration(config::KV_TTL).to_string(),
+        daily_quota =
+            config::DAILY_UPLOAD_QUOTA.map_or("unlimited".into(), |q| humanize_bytes_binary!(q)),
+        kv_min_ttl = format_duration(config::KV_MIN_TTL).to_string(),
+        kv_max_ttl = format_duration(config::KV_MAX_TTL).to_string(),
         cache_ttl = format_duration(config::CACHE_TTL).to_string(),
         upload_counter = upload_counter,
         footer = footer,
     ))
 }
 
-/// Get immutable content from the cache, or fallback to kv store and insert to cache.
+/// Build the server statistics page from the upload metrics, cached for a short time.
+#[inline(always)]
+fn get_stats() -> Result<String, Error> {
+    const KEY: &str = "_stats";
+    if let Some(found) = cache::core::lookup(KEY.into()).execute()? {
+        let mut buf = String::new();
+        found.to_stream()?.read_to_string(&mut buf)?;
+        return Ok(buf);
+    }
+
+    let kv = KVStore::open(config::KV_STORE)?.expect("kv store to exist");
+    let uploads = get_upload_count(&kv);
+
+    // Bucket metric lines by the day (utc) they were uploaded on
+    let today = SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_secs()
+        / 86400;
+    let first = today + 1 - config::STATS_DAYS;
+    let mut days = vec![0usize; config::STATS_DAYS as usize];
+    // Sizes and types are only tracked for newer uploads, so these may not cover all of them
+    let mut bytes = 0;
+    let mut types = BTreeMap::<String, usize>::new();
+    if let Ok(mut res) = kv.lookup(config::UPLOAD_METRICS_KEY) {
+        for line in res.take_body_bytes().lines().map_while(Result::ok) {
+            let mut fields = line.split(" , ");
+            let Some(Ok(millis)) = fields.next().map(str::parse::<u64>) else {
+                continue;
+            };
+            let day = millis / 86_400_000;
+            if (first..=today).contains(&day) {
+                days[(day - first) as usize] += 1;
+            }
+            for field in fields.skip(2) {
+                if let Some(size) = field.strip_prefix("size:") {
+                    bytes += size.parse::<usize>().unwrap_or_default();
+                } else if let Some(mime) = field.strip_prefix("mime:") {
+                    let kind = mime.split('/').next().unwrap_or_default();
+                    *types.entry(kind.to_string()).or_default() += 1;
+                }
+            }
+        }
+    }
+
+    let max = days.iter().copied().max().unwrap_or_default().max(1);
+    let mut stats = format!(
+        "All time uploads  :  {uploads}\nTotal size        :  {}\n\nUploads by type\n\n",
+        humanize_bytes_binary!(bytes)
+    );
+    for (kind, count) in &types {
+        stats += &format!("    {kind:<16}  {count}\n");
+    }
+    stats += &format!(
+        "\nUploads per day (last {} days, UTC)\n\n",
+        config::STATS_DAYS
+    );
+    for (i, count) in days.iter().enumerate().rev() {
+        let date = SystemTime::UNIX_EPOCH + Duration::from_secs((first + i as u64) * 86400);
+        let date = format_rfc3339_seconds(date).to_string();
+        stats += &format!(
+            "    {}  {:<40}  {count}\n",
+            &date[..10],
+            "#".repeat(count * 40 / max)
+        );
+    }
+
+    let mut w = cache::core::insert(KEY.into(), config::STATS_CACHE_TTL).execute()?;
+    w.write_all(stats.as_bytes())?;
+    w.finish()?;
+
+    Ok(stats)
+}
+
+/// Get the reason a paste was taken down by the operator, if it was
+#[inline(always)]
+fn get_takedown(id: &str) -> Option<String> {
+    fastly::ConfigStore::try_open(config::DENYLIST_STORE)
+        .ok()?
+        .get(id)
+}
+
+/// Get the metadata of a paste from the cache, or fallback to the kv store metadata, without
+/// reading the content. Also returns the cached content length, and whether it was a cache hit.
+#[inline(always)]
+fn get_paste_meta(id: &str) -> Result<(FileMetadata<'static>, Option<u64>, bool), Error> {
+    if get_takedown(id).is_some() {
+        return Err(Error::msg(format!("{id} was taken down")));
+    }
+    let key = "file_".to_string() + id;
+    if let Some(found) = cache::core::lookup(key.clone().into()).execute()? {
+        let meta = serde_json::from_slice(&found.user_metadata()).expect("corrupted metadata");
+        return Ok((meta, found.known_length(), true));
+    }
+
+    let kv = KVStore::open(config::KV_STORE)?.expect("kv store to exist");
+    let meta_bytes = kv.lookup(&key)?.metadata().unwrap();
+    let meta = serde_json::from_slice(&meta_bytes).expect("corrupted metadata");
+    Ok((meta, None, false))
+}
+
+/// Get immutable content from the cache, or fallback to kv store and insert to cache. Also
+/// returns whether the (raw or rendered) content was a cache hit.
 #[inline(always)]
 fn get_paste(
     id: &str,
-    is_markdown: bool,
+    renderer: Option<Renderer>,
     host: &str,
     filename: &str,
-) -> Result<(BodyHandle, FileMetadata<'static>), Error> {
+    nonce: usize,
+) -> Result<(BodyHandle, FileMetadata<'static>, bool), Error> {
+    // Taken down pastes may still be cached, so check before any lookups
+    if get_takedown(id).is_some() {
+        return Err(Error::msg(format!("{id} was taken down")));
+    }
     let key = "file_".to_string() + id;
 
+    // Try to find previously rendered content in cache. Keys include the build, since
+    // renderer changes would otherwise keep serving stale output.
+    let render_key = renderer.map(|r| {
+        format!(
+            "render_{}_{}_{host}_{id}_{}",
+            std::env!("CARGO_PKG_VERSION"),
+            compile_time::unix!(),
+            r.cache_key()
+        )
+    });
+    if let Some(render_key) = &render_key {
+        if let Some(found) = cache::core::lookup(render_key.clone().into()).execute()? {
+            println!("render cache hit for {render_key}");
+            let meta = serde_json::from_slice(&found.user_metadata()).expect("corrupted metadata");
+            let mut content = String::new();
+            found.to_stream()?.read_to_string(&mut content)?;
+            let html = render_page(id, &meta, &content, host, filename, nonce)?;
+            return Ok((html.into(), meta, true));
+        }
+    }
+
     // Try to find content in cache
     let string;
     let mut meta;
     if let Some(found) = cache::core::lookup(key.clone().into()).execute()? {
         meta = serde_json::from_slice(&found.user_metadata()).expect("corrupted metadata");
 
-        if !is_markdown {
-            return Ok((found.to_stream()?.into_handle(), meta));
+        if renderer.is_none() {
+            println!("cache hit for {key}");
+            return Ok((found.to_stream()?.into_handle(), meta, true));
         }
 
         let mut buf = String::new();
@@ -422,26 +2237,969 @@ fn get_paste(
         let mut w = cache::core::insert(key.to_owned().into(), config::CACHE_TTL)
             .surrogate_keys(["get"])
             .user_metadata(meta_bytes)
+            .known_length(content.len() as u64)
             .execute()?;
         w.write_all(&content)?;
         w.finish()?;
 
-        if !is_markdown {
-            return Ok((content.into(), meta));
+        if renderer.is_none() {
+            println!("cache miss for {key}");
+            return Ok((content.into(), meta, false));
         }
 
         string = String::from_utf8_lossy(&content).to_string();
     }
 
-    // render markdown
+    // render content to html
     meta.mime = Cow::from("text/html");
-    let content = markdown::to_html_with_options(&string, &markdown::Options::gfm())
-        .unwrap_or_else(|e| format!("Failed to parse github flavored markdown: {e}"));
-    let html = format!(
+    let content = match renderer {
+        Some(Renderer::Markdown) => render_markdown(&string, host),
+        Some(Renderer::Notebook) => render_notebook(&string, host),
+        Some(Renderer::Ansi) => safe_links(&linkify(&render_ansi(&string)), host),
+        Some(Renderer::Table) => render_table(&string),
+        Some(Renderer::Json) => render_json(&string),
+        Some(Renderer::Code) => safe_links(&linkify(&render_code(&string)), host),
+        None => unreachable!("raw content is returned early"),
+    };
+
+    // Write rendered content & metadata to cache
+    if let Some(render_key) = render_key {
+        println!("render cache miss for {render_key}");
+        let mut w = cache::core::insert(render_key.into(), config::CACHE_TTL)
+            .surrogate_keys(["get", "render"])
+            .user_metadata(serde_json::to_vec(&meta)?.into())
+            .execute()?;
+        w.write_all(content.as_bytes())?;
+        w.finish()?;
+    }
+
+    let html = render_page(id, &meta, &content, host, filename, nonce)?;
+    Ok((html.into(), meta, false))
+}
+
+/// Wrap rendered content into a html page, along with related links and client side scripts
+#[inline(always)]
+fn render_page(
+    id: &str,
+    meta: &FileMetadata,
+    content: &str,
+    host: &str,
+    filename: &str,
+    nonce: usize,
+) -> Result<String, Error> {
+    Ok(format!(
         include_str!("templates/markdown.html"),
-        filename = filename,
+        filename = htmlescape::encode_attribute(filename),
+        description = get_description(content),
+        url = format!("https://{host}/p/{id}"),
+        oembed = urlencoding::encode(&format!("https://{host}/p/{id}")),
+        lang = meta.language.as_deref().unwrap_or_default(),
         host = host,
+        related = get_related(id, meta)?,
+        scripts = get_render_scripts(content, nonce),
         content = content
-    );
-    Ok((html.into(), meta))
+    ))
+}
+
+/// Get a short plain text summary of rendered html, for link previews
+#[inline(always)]
+fn get_description(html: &str) -> String {
+    const MAX_LEN: usize = 200;
+
+    // Strip tags and collapse whitespace
+    let mut text = String::new();
+    let mut in_tag = false;
+    for c in html.chars() {
+        match c {
+            '<' => in_tag = true,
+            '>' => in_tag = false,
+            _ if in_tag => {},
+            c if c.is_whitespace() => {
+                if !text.is_empty() && !text.ends_with(' ') {
+                    text.push(' ');
+                }
+            },
+            c => text.push(c),
+        }
+        if text.len() >= MAX_LEN {
+            // Avoid cutting an html entity in half
+            if let Some(i) = text.rfind('&').filter(|&i| !text[i..].contains(';')) {
+                text.truncate(i);
+            }
+            text = text.trim_end().to_string() + "...";
+            break;
+        }
+    }
+    text.trim_end().replace('"', "&quot;")
+}
+
+/// Render github flavored markdown, with math support
+#[inline(always)]
+fn render_markdown(string: &str, host: &str) -> String {
+    let options = markdown::Options {
+        parse: markdown::ParseOptions {
+            constructs: markdown::Constructs {
+                math_text: true,
+                math_flow: true,
+                ..markdown::Constructs::gfm()
+            },
+            ..markdown::ParseOptions::gfm()
+        },
+        ..markdown::Options::gfm()
+    };
+    markdown::to_html_with_options(string, &options)
+        .map(|html| heading_anchors(&safe_links(&html, host)))
+        .unwrap_or_else(|e| format!("Failed to parse github flavored markdown: {e}"))
+}
+
+/// Render a jupyter notebook's cells and outputs
+#[inline(always)]
+fn render_notebook(string: &str, host: &str) -> String {
+    let notebook = match serde_json::from_str::<serde_json::Value>(string) {
+        Ok(v) => v,
+        Err(e) => return format!("Failed to parse jupyter notebook: {e}"),
+    };
+
+    // Multiline fields are either a string or a list of lines
+    let text = |v: &serde_json::Value| match v {
+        serde_json::Value::String(s) => s.clone(),
+        serde_json::Value::Array(lines) => lines.iter().filter_map(|l| l.as_str()).collect(),
+        _ => String::new(),
+    };
+    let pre = |class: &str, s: &str| {
+        format!(
+            r#"<pre class="{class}"><code>{}</code></pre>"#,
+            htmlescape::encode_minimal(&strip_ansi(s))
+        )
+    };
+
+    let lang = notebook["metadata"]["language_info"]["name"]
+        .as_str()
+        .unwrap_or("python")
+        .chars()
+        .filter(|c| c.is_ascii_alphanumeric())
+        .collect::<String>();
+    let mut html = String::new();
+    for cell in notebook["cells"].as_array().into_iter().flatten() {
+        let source = text(&cell["source"]);
+        match cell["cell_type"].as_str() {
+            Some("markdown") => html += &render_markdown(&source, host),
+            Some("code") => {
+                html += &format!(
+                    r#"<pre><code class="language-{lang}">{}</code></pre>"#,
+                    htmlescape::encode_minimal(&source)
+                )
+            },
+            _ => html += &pre("raw", &source),
+        }
+
+        for output in cell["outputs"].as_array().into_iter().flatten() {
+            let data = &output["data"];
+            match output["output_type"].as_str() {
+                Some("stream") => html += &pre("output", &text(&output["text"])),
+                Some("error") => {
+                    let traceback = output["traceback"].as_array().into_iter().flatten();
+                    let lines = traceback.filter_map(|l| l.as_str()).collect::<Vec<_>>();
+                    html += &pre("output error", &lines.join("\n"));
+                },
+                Some(_) if data["image/png"].is_string() || data["image/jpeg"].is_string() => {
+                    let (mime, image) = match data["image/png"].as_str() {
+                        Some(png) => ("image/png", png),
+                        None => (
+                            "image/jpeg",
+                            data["image/jpeg"].as_str().unwrap_or_default(),
+                        ),
+                    };
+                    let image = image.split_whitespace().collect::<String>();
+                    // Only inline valid base64, anything else could break out of the attribute
+                    if image
+                        .bytes()
+                        .all(|b| b.is_ascii_alphanumeric() || matches!(b, b'+' | b'/' | b'='))
+                    {
+                        html +=
+                            &format!(r#"<img class="output" src="data:{mime};base64,{image}">"#);
+                    } else {
+                        html += &pre("output", &text(&data["text/plain"]));
+                    }
+                },
+                // Html outputs are never rendered, fallback to the plain text representation
+                Some(_) => html += &pre("output", &text(&data["text/plain"])),
+                None => {},
+            }
+        }
+    }
+    html
+}
+
+/// Render terminal output, converting ansi sgr color and style codes into styled spans.
+#[inline(always)]
+fn render_ansi(string: &str) -> String {
+    const PALETTE: [&str; 16] = [
+        "#484f58", "#ff7b72", "#3fb950", "#d29922", "#58a6ff", "#bc8cff", "#39c5cf", "#b1bac4",
+        "#6e7681", "#ffa198", "#56d364", "#e3b341", "#79c0ff", "#d2a8ff", "#56d4dd", "#f0f6fc",
+    ];
+
+    // Convert a 256 color index to css
+    let color256 = |n: u32| match n {
+        0..=15 => PALETTE[n as usize].to_string(),
+        16..=231 => {
+            let level = |v: u32| if v == 0 { 0 } else { 55 + v * 40 };
+            let n = n - 16;
+            format!(
+                "rgb({},{},{})",
+                level(n / 36),
+                level(n / 6 % 6),
+                level(n % 6)
+            )
+        },
+        _ => {
+            let v = 8 + (n.min(255) - 232) * 10;
+            format!("rgb({v},{v},{v})")
+        },
+    };
+
+    #[derive(Default, PartialEq)]
+    struct Style {
+        fg: Option<String>,
+        bg: Option<String>,
+        bold: bool,
+        dim: bool,
+        italic: bool,
+        underline: bool,
+    }
+
+    // Write pending text to the output, wrapped in a span with the style if needed
+    fn flush(out: &mut String, style: &Style, text: &mut String) {
+        if text.is_empty() {
+            return;
+        }
+        let escaped = htmlescape::encode_minimal(text);
+        text.clear();
+        if *style == Style::default() {
+            *out += &escaped;
+            return;
+        }
+
+        let mut css = String::new();
+        if let Some(fg) = &style.fg {
+            css += &format!("color:{fg};");
+        }
+        if let Some(bg) = &style.bg {
+            css += &format!("background:{bg};");
+        }
+        if style.bold {
+            css += "font-weight:bold;";
+        }
+        if style.dim {
+            css += "opacity:0.7;";
+        }
+        if style.italic {
+            css += "font-style:italic;";
+        }
+        if style.underline {
+            css += "text-decoration:underline;";
+        }
+        *out += &format!(r#"<span style="{css}">{escaped}</span>"#);
+    }
+
+    let mut out = String::from("<pre><code>");
+    let mut style = Style::default();
+    let mut text = String::new();
+    let mut chars = string.chars().peekable();
+    while let Some(c) = chars.next() {
+        if c != '\x1b' {
+            text.push(c);
+            continue;
+        }
+        if chars.peek() != Some(&'[') {
+            continue;
+        }
+        chars.next();
+
+        // Collect the control sequence, only sgr (`m`) sequences are applied
+        let mut params = String::new();
+        let mut end = None;
+        for c in chars.by_ref() {
+            if ('@'..='~').contains(&c) {
+                end = Some(c);
+                break;
+            }
+            params.push(c);
+        }
+        if end != Some('m') {
+            continue;
+        }
+
+        // Flush text with the previous style
+        flush(&mut out, &style, &mut text);
+
+        let mut codes = params.split(';').map(|p| p.parse::<u32>().unwrap_or(0));
+        while let Some(code) = codes.next() {
+            match code {
+                0 => style = Style::default(),
+                1 => style.bold = true,
+                2 => style.dim = true,
+                3 => style.italic = true,
+                4 => style.underline = true,
+                22 => (style.bold, style.dim) = (false, false),
+                23 => style.italic = false,
+                24 => style.underline = false,
+                30..=37 => style.fg = Some(PALETTE[code as usize - 30].into()),
+                40..=47 => style.bg = Some(PALETTE[code as usize - 40].into()),
+                90..=97 => style.fg = Some(PALETTE[code as usize - 82].into()),
+                100..=107 => style.bg = Some(PALETTE[code as usize - 92].into()),
+                39 => style.fg = None,
+                49 => style.bg = None,
+                38 | 48 => {
+                    // Extended colors, either `5;n` or `2;r;g;b`
+                    let color = match codes.next() {
+                        Some(5) => codes.next().map(color256),
+                        Some(2) => {
+                            let rgb = (codes.next(), codes.next(), codes.next());
+                            match rgb {
+                                (Some(r), Some(g), Some(b)) => Some(format!("rgb({r},{g},{b})")),
+                                _ => None,
+                            }
+                        },
+                        _ => None,
+                    };
+                    if code == 38 {
+                        style.fg = color;
+                    } else {
+                        style.bg = color;
+                    }
+                },
+                _ => {},
+            }
+        }
+    }
+    flush(&mut out, &style, &mut text);
+    out + "</code></pre>"
+}
+
+/// Render csv or tsv content into a sortable table, with the first row as the header. The
+/// delimiter is detected from the first line.
+#[inline(always)]
+fn render_table(string: &str) -> String {
+    let first = string.lines().next().unwrap_or_default();
+    let delimiter = if first.matches('\t').count() > first.matches(',').count() {
+        '\t'
+    } else {
+        ','
+    };
+
+    // Parse rows, handling quoted fields with escaped quotes and newlines
+    let mut rows = vec![];
+    let mut row = vec![];
+    let mut field = String::new();
+    let mut quoted = false;
+    let mut chars = string.chars().peekable();
+    while let Some(c) = chars.next() {
+        match c {
+            '"' if quoted && chars.peek() == Some(&'"') => {
+                field.push('"');
+                chars.next();
+            },
+            '"' if quoted => quoted = false,
+            '"' if field.is_empty() => quoted = true,
+            c if quoted => field.push(c),
+            c if c == delimiter => row.push(std::mem::take(&mut field)),
+            '\r' => {},
+            '\n' => {
+                row.push(std::mem::take(&mut field));
+                rows.push(std::mem::take(&mut row));
+                // Keep one extra row past the header and limit, to know if rows were cut off
+                if rows.len() > config::CSV_MAX_ROWS + 1 {
+                    break;
+                }
+            },
+            c => field.push(c),
+        }
+    }
+    if !field.is_empty() || !row.is_empty() {
+        row.push(field);
+        rows.push(row);
+    }
+
+    let cell = |tag: &str, v: &str| format!("<{tag}>{}</{tag}>", htmlescape::encode_minimal(v));
+    let mut rows = rows.into_iter();
+    let header = rows.next().unwrap_or_default();
+    let mut html = String::from(r#"<table class="sortable"><thead><tr>"#);
+    html += &header.iter().map(|v| cell("th", v)).collect::<String>();
+    html += "</tr></thead><tbody>";
+    let mut count = 0;
+    for row in rows.by_ref().take(config::CSV_MAX_ROWS) {
+        html += "<tr>";
+        html += &row.iter().map(|v| cell("td", v)).collect::<String>();
+        html += "</tr>";
+        count += 1;
+    }
+    html += "</tbody></table>";
+    if rows.next().is_some() {
+        html += &format!("<p><em>Only showing the first {count} rows</em></p>");
+    }
+    html
+}
+
+/// Validate and pretty print a json document with syntax highlighting, or report the parse error
+/// location.
+#[inline(always)]
+fn render_json(string: &str) -> String {
+    let value = match serde_json::from_str::<serde_json::Value>(string) {
+        Ok(v) => v,
+        Err(e) => {
+            let (line, column) = (e.line(), e.column());
+            let context = string
+                .lines()
+                .nth(line.saturating_sub(1))
+                .unwrap_or_default();
+            return format!(
+                r#"<p class="error">Invalid json at line {line}, column {column}: {}</p><pre><code>{line:>5} | {}</code></pre>"#,
+                htmlescape::encode_minimal(&e.to_string()),
+                htmlescape::encode_minimal(context)
+            );
+        },
+    };
+    let pretty = serde_json::to_string_pretty(&value).unwrap_or_default();
+
+    // Highlight keys, strings, and literals in the pretty printed output
+    let span = |color: &str, token: &str| {
+        format!(
+            r#"<span style="color: {color}">{}</span>"#,
+            htmlescape::encode_minimal(token)
+        )
+    };
+    let mut html = String::from("<pre><code>");
+    let mut rest = pretty.as_str();
+    while let Some(c) = rest.chars().next() {
+        let len = match c {
+            '"' => {
+                // Find the closing quote, skipping escapes
+                let mut escaped = false;
+                let end = rest[1..]
+                    .find(|c| {
+                        let found = c == '"' && !escaped;
+                        escaped = c == '\\' && !escaped;
+                        found
+                    })
+                    .map_or(rest.len(), |i| i + 2);
+                let is_key = rest[end..].starts_with(':');
+                html += &span(if is_key { "#79c0ff" } else { "#a5d6ff" }, &rest[..end]);
+                end
+            },
+            '-' | '0'..='9' | 't' | 'f' | 'n' => {
+                let end = rest
+                    .find(|c: char| !(c.is_ascii_alphanumeric() || matches!(c, '-' | '+' | '.')))
+                    .unwrap_or(rest.len());
+                html += &span("#ff7b72", &rest[..end]);
+                end
+            },
+            c => {
+                html.push(c);
+                c.len_utf8()
+            },
+        };
+        rest = &rest[len..];
+    }
+    html + "</code></pre>"
+}
+
+/// Render text with an anchor for each line (ie, `#L42`)
+#[inline(always)]
+fn render_code(string: &str) -> String {
+    let width = string.lines().count().to_string().len();
+    let mut html = String::from(r#"<pre class="code"><code>"#);
+    for (i, line) in string.lines().enumerate() {
+        let n = i + 1;
+        html += &format!(
+            r##"<span id="L{n}" class="line"><a href="#L{n}">{n:>width$}</a> {}</span>"##,
+            htmlescape::encode_minimal(line)
+        );
+        html.push('\n');
+    }
+    html + "</code></pre>"
+}
+
+/// Strip ansi escape sequences (ie, colors in tracebacks) from text
+#[inline(always)]
+fn strip_ansi(s: &str) -> String {
+    let mut out = String::with_capacity(s.len());
+    let mut chars = s.chars();
+    while let Some(c) = chars.next() {
+        if c != '\x1b' {
+            out.push(c);
+            continue;
+        }
+        // Skip control sequence parameters up to the final byte
+        if chars.next() == Some('[') {
+            for c in chars.by_ref() {
+                if ('@'..='~').contains(&c) {
+                    break;
+                }
+            }
+        }
+    }
+    out
+}
+
+/// Get the client side scripts for math, mermaid diagrams, line ranges, and sortable tables, only
+/// if the document uses them. Katex and mermaid are pinned versions served from `/static/`, and
+/// all scripts are allowed via the nonce.
+#[inline(always)]
+fn get_render_scripts(html: &str, nonce: usize) -> String {
+    // Vendored into the kv store rather than loaded from a cdn, since they run as first party
+    const KATEX: &str = "/static/katex@0.16.11";
+    const MERMAID: &str = "/static/mermaid@11.4.0/mermaid.min.js";
+
+    let mut scripts = String::new();
+    if html.contains("language-math") {
+        scripts += &format!(
+            r#"<link rel="stylesheet" href="{KATEX}/katex.min.css">
+<script nonce="{nonce}" src="{KATEX}/katex.min.js"></script>
+<script nonce="{nonce}">
+    document.querySelectorAll('code.language-math').forEach(el => {{
+        const display = el.classList.contains('math-display');
+        const target = display ? el.parentElement : el;
+        katex.render(el.textContent, target, {{ displayMode: display, throwOnError: false }});
+    }});
+</script>
+"#
+        );
+    }
+    if html.contains("language-mermaid") {
+        scripts += &format!(
+            r#"<script nonce="{nonce}" src="{MERMAID}"></script>
+<script nonce="{nonce}">
+    const nodes = [...document.querySelectorAll('code.language-mermaid')].map(el => {{
+        const pre = el.parentElement;
+        pre.classList.add('mermaid');
+        pre.textContent = el.textContent;
+        return pre;
+    }});
+    mermaid.initialize({{ startOnLoad: false, theme: 'dark' }});
+    mermaid.run({{ nodes }});
+</script>
+"#
+        );
+    }
+    if html.contains(r#"<pre class="code">"#) {
+        scripts += &format!(
+            r#"<script nonce="{nonce}">
+    // Highlight line ranges from the fragment, ie `#L10` or `#L10-L20`, or from `?code&lines=10-20`
+    const highlight = () => {{
+        const lines = new URLSearchParams(location.search).get('lines');
+        const m = location.hash.match(/^#L(\d+)(?:-L(\d+))?$/)
+            || (lines || '').match(/^(\d+)(?:-(\d+))?$/);
+        if (!m) return;
+        const [start, end] = [+m[1], +(m[2] || m[1])];
+        document.querySelectorAll('.line').forEach((el, i) =>
+            el.classList.toggle('hl', i + 1 >= start && i + 1 <= end));
+        document.getElementById(`L${{start}}`)?.scrollIntoView({{ block: 'center' }});
+    }};
+    window.addEventListener('hashchange', highlight);
+    highlight();
+</script>
+"#
+        );
+    }
+    if html.contains(r#"<table class="sortable">"#) {
+        scripts += &format!(
+            r#"<script nonce="{nonce}">
+    // Sort table rows by a column when clicking its header, toggling the direction
+    document.querySelectorAll('table.sortable th').forEach((th, i) => {{
+        th.style.cursor = 'pointer';
+        th.addEventListener('click', () => {{
+            const body = th.closest('table').tBodies[0];
+            const dir = th.dataset.dir = th.dataset.dir === 'asc' ? 'desc' : 'asc';
+            const value = row => row.cells[i] ? row.cells[i].textContent : '';
+            const collator = new Intl.Collator(undefined, {{ numeric: true }});
+            [...body.rows]
+                .sort((a, b) => collator.compare(value(a), value(b)) * (dir === 'asc' ? 1 : -1))
+                .forEach(row => body.appendChild(row));
+        }});
+    }});
+</script>
+"#
+        );
+    }
+    scripts
+}
+
+/// Add anchor ids to rendered headings, and prepend a table of contents for longer documents.
+#[inline(always)]
+fn heading_anchors(html: &str) -> String {
+    let mut out = String::with_capacity(html.len());
+    let mut toc = Vec::new();
+    let mut slugs = BTreeMap::new();
+    let mut rest = html;
+    while let Some(start) = rest.find("<h") {
+        out += &rest[..start];
+        rest = &rest[start..];
+
+        // Only match plain `<h1>` through `<h6>` tags
+        let level = rest.as_bytes().get(2).copied().unwrap_or_default();
+        let is_heading = (b'1'..=b'6').contains(&level) && rest.as_bytes().get(3) == Some(&b'>');
+        // Check the tag before searching for its close, which would otherwise scan the rest of
+        // the document for every other tag starting with `<h`
+        let close = format!("</h{}>", level as char);
+        let end = if is_heading { rest.find(&close) } else { None };
+        let Some(end) = end else {
+            out += "<h";
+            rest = &rest[2..];
+            continue;
+        };
+        let inner = &rest[4..end];
+        rest = &rest[end + close.len()..];
+
+        // Build a github style slug from the heading text, without any inline tags
+        let mut text = String::new();
+        let mut in_tag = false;
+        for c in inner.chars() {
+            match c {
+                '<' => in_tag = true,
+                '>' => in_tag = false,
+                c if !in_tag => text.push(c),
+                _ => {},
+            }
+        }
+        let mut slug = text
+            .to_lowercase()
+            .split(|c: char| !(c.is_alphanumeric() || c == '-' || c == '_'))
+            .filter(|w| !w.is_empty())
+            .collect::<Vec<_>>()
+            .join("-");
+        let dupes = slugs.entry(slug.clone()).or_insert(0usize);
+        *dupes += 1;
+        let dupes = *dupes - 1;
+        if dupes > 0 {
+            slug += &format!("-{dupes}");
+        }
+
+        out += &format!(
+            r##"<h{l} id="{slug}"><a class="anchor" href="#{slug}">#</a>{inner}{close}"##,
+            l = level as char
+        );
+        toc.push((level - b'0', slug, text));
+    }
+    out += rest;
+
+    if toc.len() < config::MARKDOWN_TOC_MIN_HEADINGS {
+        return out;
+    }
+    let items = toc
+        .iter()
+        .map(|(level, slug, text)| {
+            format!(
+                r##"<li style="margin-left: {}rem"><a href="#{slug}">{text}</a></li>"##,
+                level - 1
+            )
+        })
+        .collect::<String>();
+    format!(r#"<nav class="toc"><ul>{items}</ul></nav>"#) + &out
+}
+
+/// Render the declared license and links to the paste this one is a reply to, and any replies
+/// superseding it.
+#[inline(always)]
+fn get_related(id: &str, meta: &FileMetadata) -> Result<String, Error> {
+    let mut links = Vec::new();
+    if let Some(license) = &meta.license {
+        links.push(format!(
+            r#"license <a href="https://spdx.org/licenses/{license}.html">{license}</a>"#
+        ));
+    }
+    if let Some(parent) = &meta.reply_to {
+        links.push(format!(
+            r#"in reply to <a href="/p/{parent}?md">{parent}</a>"#
+        ));
+    }
+
+    let kv = KVStore::open(config::KV_STORE)?.expect("kv store to exist");
+    if let Ok(mut res) = kv.lookup(&format!("replies_{id}")) {
+        let replies = res
+            .take_body_bytes()
+            .lines()
+            .map_while(Result::ok)
+            .map(|r| format!(r#"<a href="/p/{r}?md">{r}</a>"#))
+            .collect::<Vec<_>>();
+        if !replies.is_empty() {
+            links.push(format!("superseded by {}", replies.join(", ")));
+        }
+    }
+
+    if links.is_empty() {
+        return Ok(String::new());
+    }
+    Ok(format!(
+        r#"<nav class="related">{}</nav>"#,
+        links.join(" &middot; ")
+    ))
+}
+
+/// Wrap bare http(s) urls in the text of rendered html with links, for plain text views
+#[inline(always)]
+fn linkify(html: &str) -> String {
+    let mut out = String::with_capacity(html.len());
+    let mut rest = html;
+    while !rest.is_empty() {
+        // Copy tags through untouched
+        if rest.starts_with('<') {
+            let end = rest.find('>').map_or(rest.len(), |i| i + 1);
+            out += &rest[..end];
+            rest = &rest[end..];
+            continue;
+        }
+        let end = rest.find('<').unwrap_or(rest.len());
+        let mut text = &rest[..end];
+        rest = &rest[end..];
+
+        // Scan forward from the last match, so long text is only searched once
+        let mut from = 0;
+        while let Some(found) = text[from..].find("http") {
+            let start = from + found;
+            let after = &text[start + 4..];
+            if !after.starts_with("s://") && !after.starts_with("://") {
+                from = start + 4;
+                continue;
+            }
+            // Text is html escaped, so also stop at escaped delimiters
+            let tail = &text[start..];
+            let len = tail
+                .char_indices()
+                .find(|&(i, c)| {
+                    c.is_whitespace()
+                        || c == '"'
+                        || c == '\''
+                        || (c == '&'
+                            && ["&lt;", "&gt;", "&quot;", "&#x27;"]
+                                .iter()
+                                .any(|stop| tail[i..].starts_with(stop)))
+                })
+                .map_or(tail.len(), |(i, _)| i);
+            let url = tail[..len].trim_end_matches(['.', ',', ':', ')', '!', '?']);
+            out += &text[..start];
+            out += &format!(r#"<a href="{url}">{url}</a>"#);
+            text = &text[start + url.len()..];
+            from = 0;
+        }
+        out += text;
+    }
+    out
+}
+
+/// Mark links in rendered html as nofollow/noopener, and route links to untrusted domains through
+/// the exit page to avoid rendered pastes becoming a phishing vector.
+#[inline(always)]
+fn safe_links(html: &str, host: &str) -> String {
+    const ANCHOR: &str = "<a href=\"";
+
+    let mut out = String::with_capacity(html.len());
+    let mut rest = html;
+    while let Some(start) = rest.find(ANCHOR) {
+        out += &rest[..start];
+        rest = &rest[start + ANCHOR.len()..];
+        let end = rest.find('"').unwrap_or(rest.len());
+        let (href, tail) = rest.split_at(end);
+        rest = tail;
+
+        // Hrefs are attribute encoded by the renderer
+        let target = htmlescape::decode_html(href).unwrap_or_default();
+
+        // Browsers ignore scheme case and leading whitespace, read backslashes as slashes, and
+        // resolve protocol relative links to other hosts
+        let normalized = target.trim_start().to_lowercase().replace('\\', "/");
+        let (domain, exit) = match ["https://", "http://", "//"]
+            .iter()
+            .find(|p| normalized.starts_with(*p))
+        {
+            Some(prefix) => {
+                // Authority up to the path, without userinfo or port
+                let rest = &normalized[prefix.len()..];
+                let authority = rest.split(['/', '?', '#']).next().unwrap_or_default();
+                let authority = authority.rsplit('@').next().unwrap_or_default();
+                let domain = authority.split(':').next().unwrap_or_default();
+                let scheme = if *prefix == "//" { "https://" } else { prefix };
+                let url = scheme.to_string() + &target.trim_start()[prefix.len()..];
+                (Some(domain.to_string()), url)
+            },
+            None => (None, target.clone()),
+        };
+        let trusted = domain.map_or(true, |d| {
+            d == host.to_lowercase()
+                || config::TRUSTED_LINK_DOMAINS
+                    .iter()
+                    .any(|t| d == *t || d.ends_with(&format!(".{t}")))
+        });
+
+        out += r#"<a rel="nofollow noopener noreferrer" href=""#;
+        if trusted {
+            out += href;
+        } else {
+            out += "/exit?url=";
+            out += &urlencoding::encode(&exit);
+        }
+    }
+    out += rest;
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const PNG_SIGNATURE: &[u8] = b"\x89PNG\r\n\x1a\n";
+
+    fn png_chunk(kind: &[u8; 4], data: &[u8]) -> Vec<u8> {
+        let mut chunk = (data.len() as u32).to_be_bytes().to_vec();
+        chunk.extend_from_slice(kind);
+        chunk.extend_from_slice(data);
+        chunk.extend_from_slice(&[0; 4]);
+        chunk
+    }
+
+    fn jpeg_segment(marker: u8, data: &[u8]) -> Vec<u8> {
+        let mut segment = vec![0xFF, marker];
+        segment.extend_from_slice(&(data.len() as u16 + 2).to_be_bytes());
+        segment.extend_from_slice(data);
+        segment
+    }
+
+    fn is_exit_link(href: &str) -> bool {
+        safe_links(&format!(r#"<a href="{href}">x</a>"#), "0dd.sh").contains("/exit?url=")
+    }
+
+    #[test]
+    fn safe_links_trusts_own_and_listed_hosts() {
+        assert!(!is_exit_link("https://0dd.sh/p/abc"));
+        assert!(!is_exit_link("https://0DD.sh/p/abc"));
+        assert!(!is_exit_link("https://github.com/ozwaldorf/0dd.sh"));
+        assert!(!is_exit_link("https://docs.github.com:443/x"));
+        assert!(!is_exit_link("/p/abc"));
+        assert!(!is_exit_link("#heading"));
+    }
+
+    #[test]
+    fn safe_links_routes_other_hosts_through_exit() {
+        assert!(is_exit_link("https://evil.com/login"));
+        assert!(is_exit_link("HTTPS://EVIL.com"));
+        assert!(is_exit_link("//evil.com/login"));
+        assert!(is_exit_link("https:\\\\evil.com"));
+        assert!(is_exit_link(" https://evil.com"));
+        // userinfo before the real host
+        assert!(is_exit_link("https://github.com:x@evil.com/login"));
+        assert!(is_exit_link("https://github.com@evil.com"));
+        assert!(is_exit_link("https://evil.com#@github.com"));
+    }
+
+    #[test]
+    fn linkify_wraps_urls_in_text() {
+        assert_eq!(
+            linkify("see https://a.b/c. and http://d.e<b>https://f.g</b> httpx"),
+            r#"see <a href="https://a.b/c">https://a.b/c</a>. and <a href="http://d.e">http://d.e</a><b><a href="https://f.g">https://f.g</a></b> httpx"#
+        );
+        assert_eq!(
+            linkify("https://a.b&lt;x&gt;"),
+            r#"<a href="https://a.b">https://a.b</a>&lt;x&gt;"#
+        );
+    }
+
+    #[test]
+    fn linkify_is_linear() {
+        let text = "https://a.b ".repeat(80_000);
+        let start = std::time::Instant::now();
+        assert_eq!(linkify(&text).matches("<a ").count(), 80_000);
+        let text = "https://a.b&lt;".repeat(80_000);
+        linkify(&text);
+        assert!(start.elapsed() < Duration::from_secs(5));
+    }
+
+    #[test]
+    fn heading_anchors_skip_other_tags() {
+        let html = heading_anchors("<hr /><h2>Hello World</h2><h2>Hello World</h2><h7>x</h7>");
+        assert!(html.starts_with("<hr />"));
+        assert!(html.contains(r#"id="hello-world""#));
+        assert!(html.contains(r#"id="hello-world-1""#));
+        assert!(html.contains("<h7>x</h7>"));
+
+        let start = std::time::Instant::now();
+        heading_anchors(&"<hr />\n".repeat(80_000));
+        assert!(start.elapsed() < Duration::from_secs(5));
+    }
+
+    #[test]
+    fn guess_language_from_content() {
+        let lang = |text| guess_language(text).map(|(lang, _, _)| lang);
+        assert_eq!(lang("#!/usr/bin/env python3\nprint(1)"), Some("python"));
+        assert_eq!(lang("#!/bin/sh\necho hi"), Some("bash"));
+        assert_eq!(lang("<?php echo 1;"), Some("php"));
+        assert_eq!(lang(r#"{"a": [1, 2]}"#), Some("json"));
+        assert_eq!(
+            lang("fn main() -> Result<()> {\n    let mut x = 1;\n}"),
+            Some("rust")
+        );
+        assert_eq!(
+            lang("package main\n\nfunc main() {\n\tx := 1\n}"),
+            Some("go")
+        );
+        assert_eq!(lang("hello world"), None);
+    }
+
+    #[test]
+    fn strip_ignores_other_content() {
+        assert_eq!(strip_metadata(b"hello world"), Ok(None));
+    }
+
+    #[test]
+    fn strip_jpeg_metadata() {
+        let scan = [0xFF, 0xDA, 0x00, 0x02, 0x12, 0x34, 0xFF, 0xD9];
+        let quant = jpeg_segment(0xDB, &[1, 2, 3]);
+        let body = [
+            &[0xFF, 0xD8][..],
+            &jpeg_segment(0xE1, b"Exif\0\0gps"),
+            // fill bytes and a standalone marker
+            &[0xFF, 0xFF, 0xFF, 0x01],
+            &jpeg_segment(0xED, b"iptc"),
+            &quant,
+            &scan,
+        ]
+        .concat();
+        let expected = [&[0xFF, 0xD8, 0xFF, 0x01][..], &quant, &scan].concat();
+        assert_eq!(strip_metadata(&body), Ok(Some(expected)));
+    }
+
+    #[test]
+    fn strip_png_metadata() {
+        let header = png_chunk(b"IHDR", &[0; 13]);
+        let data = png_chunk(b"IDAT", b"pixels");
+        let end = png_chunk(b"IEND", b"");
+        let body = [
+            PNG_SIGNATURE,
+            &header,
+            &png_chunk(b"eXIf", b"gps"),
+            &png_chunk(b"tEXt", b"comment"),
+            &data,
+            &end,
+            // trailing data after the end is dropped
+            b"appended exif",
+        ]
+        .concat();
+        let expected = [PNG_SIGNATURE, &header, &data, &end].concat();
+        assert_eq!(strip_metadata(&body), Ok(Some(expected)));
+    }
+
+    #[test]
+    fn strip_rejects_malformed_images() {
+        // truncated segment
+        let jpeg = [&[0xFF, 0xD8][..], &jpeg_segment(0xE1, b"Exif")[..5]].concat();
+        assert!(strip_metadata(&jpeg).is_err());
+        // garbage between segments
+        let jpeg = [&[0xFF, 0xD8, 0x00][..], &jpeg_segment(0xE1, b"Exif")].concat();
+        assert!(strip_metadata(&jpeg).is_err());
+        // missing end chunk
+        let png = [PNG_SIGNATURE, &png_chunk(b"eXIf", b"gps")].concat();
+        assert!(strip_metadata(&png).is_err());
+        // chunk length that overflows a 32 bit usize
+        let png = [PNG_SIGNATURE, &[0xFF, 0xFF, 0xFF, 0xF4], b"eXIf", b"gps"].concat();
+        assert!(strip_metadata(&png).is_err());
+    }
 }
@@ -0,0 +1,16 @@
+(() => {{
+    const script = document.currentScript;
+    const frame = document.createElement("iframe");
+    frame.src = "https://{host}/embed/{id}";
+    frame.title = "{id} - {host}";
+    frame.loading = "lazy";
+    frame.style = "width: 100%; height: 8em; border: 1px solid #30363d; border-radius: 6px;";
+    script.after(frame);
+
+    // Resize the frame to fit the paste
+    window.addEventListener("message", (event) => {{
+        if (event.origin === "https://{host}" && event.data && event.data.embed === "{id}") {{
+            frame.style.height = `${{event.data.height}}px`;
+        }}
+    }});
+}})();